@@ -0,0 +1,301 @@
+// Package esm finds module specifiers in JavaScript source.
+//
+// It tokenizes just enough of the language to skip strings, comments,
+// templates and regular expressions, without building a syntax tree.
+package esm
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// Import is a module specifier in static imports, re-exports or dynamic
+// imports with a string literal argument.
+type Import struct {
+	Specifier string
+	// Start and End are the offsets of the specifier in the source,
+	// excluding quotes
+	Start, End int
+}
+
+// Imports returns the module specifiers in src, in source order
+func Imports(src []byte) []Import {
+	toks := tokenize(src)
+
+	var imports []Import
+	for i := 0; i < len(toks); i++ {
+		tok := toks[i]
+		if tok.kind != identTok || (i > 0 && toks[i-1].is(".")) {
+			continue
+		}
+
+		switch tok.text(src) {
+		case "import":
+			next := at(toks, i+1)
+			switch {
+			case next.kind == stringTok:
+				// import "x"
+				imports = appendImport(imports, src, next)
+			case next.is("("):
+				// import("x")
+				if arg := at(toks, i+2); arg.kind == stringTok && (at(toks, i+3).is(")") || at(toks, i+3).is(",")) {
+					imports = appendImport(imports, src, arg)
+				}
+			case next.is("."):
+				// import.meta
+			default:
+				if from, ok := fromClause(toks, src, i+1); ok {
+					imports = appendImport(imports, src, from)
+				}
+			}
+		case "export":
+			if next := at(toks, i+1); next.is("*") || next.is("{") {
+				if from, ok := fromClause(toks, src, i+1); ok {
+					imports = appendImport(imports, src, from)
+				}
+			}
+		}
+	}
+	return imports
+}
+
+// fromClause skips an import or export clause starting at toks[i], such as
+// "x, { a as b }" or "* as ns", returning the string following "from"
+func fromClause(toks []token, src []byte, i int) (token, bool) {
+	for ; i < len(toks); i++ {
+		tok := toks[i]
+		switch {
+		case tok.kind == identTok && tok.text(src) == "from":
+			if next := at(toks, i+1); next.kind == stringTok {
+				return next, true
+			}
+			// A binding named "from"
+		case tok.kind == identTok, tok.is("*"), tok.is(","):
+		case tok.is("{"):
+			// Skip named bindings, which may include string names
+			for i++; i < len(toks) && !toks[i].is("}"); i++ {
+				if k := toks[i].kind; k != identTok && k != stringTok && !toks[i].is(",") {
+					return token{}, false
+				}
+			}
+		default:
+			return token{}, false
+		}
+	}
+	return token{}, false
+}
+
+// appendImport appends the string literal tok to imports, ignoring
+// literals containing escapes
+func appendImport(imports []Import, src []byte, tok token) []Import {
+	start, end := tok.start+1, tok.end-1
+	if end < start || bytes.IndexByte(src[start:end], '\\') >= 0 {
+		return imports
+	}
+	return append(imports, Import{Specifier: string(src[start:end]), Start: start, End: end})
+}
+
+type tokenKind int
+
+const (
+	punctTok tokenKind = iota
+	identTok
+	numberTok
+	stringTok
+	templateTok
+	regexTok
+)
+
+type token struct {
+	kind       tokenKind
+	start, end int
+	punct      byte
+}
+
+func (t token) is(punct string) bool {
+	return t.kind == punctTok && t.end > t.start && t.punct == punct[0] && len(punct) == 1
+}
+
+func (t token) text(src []byte) string {
+	return string(src[t.start:t.end])
+}
+
+// at returns toks[i] or an empty token if i is out of range
+func at(toks []token, i int) token {
+	if i >= len(toks) {
+		return token{}
+	}
+	return toks[i]
+}
+
+// regexPrecedingKeywords are keywords after which a slash starts a regular
+// expression rather than division
+var regexPrecedingKeywords = map[string]bool{
+	"return": true, "typeof": true, "instanceof": true, "in": true,
+	"of": true, "new": true, "delete": true, "void": true, "throw": true,
+	"case": true, "do": true, "else": true, "yield": true, "await": true,
+}
+
+// tokenize splits src into tokens, skipping whitespace and comments.
+// Template literals are a single token, including substitutions.
+func tokenize(src []byte) []token {
+	var (
+		toks []token
+		// braces tracks open braces, true for template substitutions
+		braces []bool
+	)
+
+	regexAllowed := func() bool {
+		if len(toks) == 0 {
+			return true
+		}
+		last := toks[len(toks)-1]
+		switch last.kind {
+		case identTok:
+			return regexPrecedingKeywords[last.text(src)]
+		case punctTok:
+			return last.punct != ')' && last.punct != ']' && last.punct != '}'
+		}
+		return false
+	}
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+			i++
+		case c == '/' && i+1 < len(src) && src[i+1] == '/':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := bytes.Index(src[i+2:], []byte("*/"))
+			if end < 0 {
+				return toks
+			}
+			i += end + 4
+		case c == '\'' || c == '"':
+			end := skipString(src, i)
+			toks = append(toks, token{kind: stringTok, start: i, end: end})
+			i = end
+		case c == '`':
+			end, open := skipTemplate(src, i+1)
+			toks = append(toks, token{kind: templateTok, start: i, end: end})
+			if open {
+				braces = append(braces, true)
+			}
+			i = end
+		case c == '}' && len(braces) > 0 && braces[len(braces)-1]:
+			// End of a template substitution, continue the template
+			braces = braces[:len(braces)-1]
+			end, open := skipTemplate(src, i+1)
+			toks = append(toks, token{kind: templateTok, start: i, end: end})
+			if open {
+				braces = append(braces, true)
+			}
+			i = end
+		case c == '/' && regexAllowed():
+			end := skipRegex(src, i+1)
+			toks = append(toks, token{kind: regexTok, start: i, end: end})
+			i = end
+		case isIdentStart(c):
+			start := i
+			for i < len(src) && isIdentPart(src[i]) {
+				if src[i] >= utf8.RuneSelf {
+					_, size := utf8.DecodeRune(src[i:])
+					i += size
+					continue
+				}
+				i++
+			}
+			toks = append(toks, token{kind: identTok, start: start, end: i})
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			start := i
+			for i < len(src) && (isIdentPart(src[i]) || src[i] == '.') {
+				i++
+			}
+			toks = append(toks, token{kind: numberTok, start: start, end: i})
+		default:
+			switch c {
+			case '{':
+				braces = append(braces, false)
+			case '}':
+				if len(braces) > 0 {
+					braces = braces[:len(braces)-1]
+				}
+			}
+			toks = append(toks, token{kind: punctTok, start: i, end: i + 1, punct: c})
+			i++
+		}
+	}
+	return toks
+}
+
+// skipString returns the offset after the string literal starting at i
+func skipString(src []byte, i int) int {
+	quote := src[i]
+	for i++; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+		case quote:
+			return i + 1
+		case '\n':
+			return i // Unterminated
+		}
+	}
+	return len(src)
+}
+
+// skipTemplate returns the offset after the template literal or the start
+// of a substitution ("${"), reporting whether a substitution was opened
+func skipTemplate(src []byte, i int) (int, bool) {
+	for ; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+		case '`':
+			return i + 1, false
+		case '$':
+			if i+1 < len(src) && src[i+1] == '{' {
+				return i + 2, true
+			}
+		}
+	}
+	return len(src), false
+}
+
+// skipRegex returns the offset after the regular expression literal,
+// including flags, whose body starts at i
+func skipRegex(src []byte, i int) int {
+	inClass := false
+	for ; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+		case '[':
+			inClass = true
+		case ']':
+			inClass = false
+		case '/':
+			if !inClass {
+				i++
+				for i < len(src) && isIdentPart(src[i]) {
+					i++
+				}
+				return i
+			}
+		case '\n':
+			return i // Unterminated
+		}
+	}
+	return len(src)
+}
+
+func isIdentStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '$' || c == '\\' || c >= utf8.RuneSelf
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || c >= '0' && c <= '9'
+}
@@ -0,0 +1,48 @@
+package esm
+
+import (
+	"reflect"
+	"testing"
+)
+
+var importsTests = map[string]struct {
+	src  string
+	want []string
+}{
+	"default":         {src: `import React from "react";`, want: []string{"react"}},
+	"named":           {src: `import { a, b as c } from './util'`, want: []string{"./util"}},
+	"namespace":       {src: `import * as path from 'path-browserify'`, want: []string{"path-browserify"}},
+	"default+named":   {src: `import x, { y } from "@scope/pkg/sub"`, want: []string{"@scope/pkg/sub"}},
+	"side effect":     {src: `import "./polyfill.js"`, want: []string{"./polyfill.js"}},
+	"dynamic":         {src: `const m = await import('./lazy')`, want: []string{"./lazy"}},
+	"dynamic expr":    {src: `import(name)`, want: nil},
+	"export from":     {src: `export { default } from "./a"; export * from './b'; export * as c from "c"`, want: []string{"./a", "./b", "c"}},
+	"export local":    {src: `export { a }; export const from = "x"`, want: nil},
+	"import.meta":     {src: `const u = import.meta.url; import "a"`, want: []string{"a"}},
+	"comment":         {src: "// import 'no'\n/* import \"no\" */ import 'yes'", want: []string{"yes"}},
+	"string":          {src: `const s = "import 'no'"; import 'yes'`, want: []string{"yes"}},
+	"template":        {src: "const s = `import 'no' ${ {a: `import 'no'`}.a } import 'no'`; import 'yes'", want: []string{"yes"}},
+	"regex":           {src: `const re = /import 'no'/g; import 'yes'`, want: []string{"yes"}},
+	"regex class":     {src: `x = /[/]import 'no'/; import 'yes'`, want: []string{"yes"}},
+	"division":        {src: `a = b / c; d = e / f; import 'yes'`, want: []string{"yes"}},
+	"property import": {src: `obj.import("no"); import 'yes'`, want: []string{"yes"}},
+	"escaped":         {src: `import "\u0061"`, want: nil},
+	"multiline":       {src: "import {\n  a,\n  b,\n} from 'multi'", want: []string{"multi"}},
+}
+
+func TestImports(t *testing.T) {
+	for label, tt := range importsTests {
+		t.Run(label, func(t *testing.T) {
+			var got []string
+			for _, imp := range Imports([]byte(tt.src)) {
+				if s := tt.src[imp.Start:imp.End]; s != imp.Specifier {
+					t.Errorf("source[%d:%d] = %q, want %q", imp.Start, imp.End, s, imp.Specifier)
+				}
+				got = append(got, imp.Specifier)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Imports(%s) = %q, want %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,378 @@
+package extract
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// ArchiveFile is the uncompressed tarball written by TGZArchive
+	ArchiveFile = "package.tar"
+	// IndexFile is the index of ArchiveFile written by TGZArchive. No
+	// package would contain it, so it marks directories as archives.
+	IndexFile = "package.tar.index"
+)
+
+// archiveEntry is a file or directory in an archive index
+type archiveEntry struct {
+	Name    string // slash separated, relative to the package root
+	Offset  int64  // of the file content in ArchiveFile
+	Size    int64
+	Mode    fs.FileMode
+	ModTime time.Time
+}
+
+// archiveLink is a link whose target is resolved once all entries are read
+type archiveLink struct {
+	name, target string
+	modTime      time.Time
+}
+
+// TGZArchive decompresses a tar/gzipped file into dir as ArchiveFile,
+// without extracting it, and writes the offsets of its files to IndexFile
+// so that OpenArchive can serve them. Gzip streams can't be seeked, so the
+// tarball is decompressed once here rather than on every read.
+//
+// Entry paths are stripped and checked as by TGZ. Links within the
+// package are indexed as copies of the files they refer to.
+func TGZArchive(r io.Reader, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(dir, ArchiveFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bw := bufio.NewWriter(f)
+
+	// The tar reader reads exactly up to the content of each entry, so the
+	// count after reading its header is the offset of the content
+	cr := &countingReader{r: io.TeeReader(gr, bw)}
+	tr := tar.NewReader(cr)
+
+	var (
+		root    rootDir
+		entries []archiveEntry
+		links   []archiveLink
+	)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		if isAbs(hdr.Name) {
+			return ErrUnsafePath
+		}
+		name := strings.TrimPrefix(hdr.Name, "./")
+
+		if !root.detected {
+			root.detect(name, hdr.Typeflag == tar.TypeDir)
+		}
+		rel, ok := root.strip(name)
+		if !ok {
+			// As in TGZ, the root is part of the paths after all
+			for i := range entries {
+				entries[i].Name = path.Join(root.name, entries[i].Name)
+			}
+			for i := range links {
+				links[i].name = path.Join(root.name, links[i].name)
+				links[i].target = path.Join(root.name, links[i].target)
+			}
+			root.name = ""
+			rel = name
+		}
+
+		if _, err := safeJoin(dir, rel); err != nil {
+			return err
+		}
+		rel = path.Clean("/" + strings.Replace(rel, `\`, "/", -1))[1:]
+		if rel == "" {
+			continue // The root directory
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			entries = append(entries, archiveEntry{
+				Name:    rel,
+				Mode:    fs.ModeDir | hdr.FileInfo().Mode().Perm() | 0700,
+				ModTime: hdr.ModTime,
+			})
+		case tar.TypeReg, tar.TypeRegA:
+			if isSparse(hdr) {
+				log.Printf("Skipping sparse file %q\n", hdr.Name)
+				continue
+			}
+			entries = append(entries, archiveEntry{
+				Name:    rel,
+				Offset:  cr.n,
+				Size:    hdr.Size,
+				Mode:    hdr.FileInfo().Mode().Perm() | 0600,
+				ModTime: hdr.ModTime,
+			})
+		case tar.TypeSymlink:
+			target := path.Join(path.Dir(rel), strings.Replace(hdr.Linkname, `\`, "/", -1))
+			if isAbs(hdr.Linkname) || target == ".." || strings.HasPrefix(target, "../") {
+				log.Printf("Skipping symlink %q to %q outside of package\n", hdr.Name, hdr.Linkname)
+				continue
+			}
+			links = append(links, archiveLink{name: rel, target: target, modTime: hdr.ModTime})
+		case tar.TypeLink:
+			target, ok := root.strip(strings.TrimPrefix(hdr.Linkname, "./"))
+			_, err := safeJoin(dir, target)
+			if isAbs(hdr.Linkname) || !ok || err != nil {
+				log.Printf("Skipping hardlink %q to %q outside of package\n", hdr.Name, hdr.Linkname)
+				continue
+			}
+			links = append(links, archiveLink{name: rel, target: path.Clean("/" + target)[1:], modTime: hdr.ModTime})
+		default:
+			log.Printf("Skipping %q with unsupported type %q\n", hdr.Name, hdr.Typeflag)
+		}
+	}
+
+	// Keep the end of the archive, so that it's a valid tarball
+	if _, err := io.Copy(ioutil.Discard, cr); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(indexEntries(entries, links))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, IndexFile), b, 0644)
+}
+
+// indexEntries returns the entries to index, with later entries replacing
+// earlier ones of the same name as they would when extracted, and links
+// resolved to the files they refer to. Links to directories or missing
+// files are skipped.
+func indexEntries(entries []archiveEntry, links []archiveLink) []archiveEntry {
+	byName := make(map[string]archiveEntry, len(entries)+len(links))
+	for _, e := range entries {
+		byName[e.Name] = e
+	}
+
+	// Links may refer to other links, resolve until no more can be
+	for resolved := true; resolved; {
+		resolved = false
+		remaining := links[:0]
+		for _, l := range links {
+			target, ok := byName[l.target]
+			switch {
+			case !ok:
+				remaining = append(remaining, l)
+			case target.Mode.IsDir():
+				log.Printf("Skipping link %q to directory %q\n", l.name, l.target)
+			default:
+				if _, exists := byName[l.name]; !exists {
+					target.Name, target.ModTime = l.name, l.modTime
+					byName[l.name] = target
+				}
+				resolved = true
+			}
+		}
+		links = remaining
+	}
+	for _, l := range links {
+		log.Printf("Skipping link %q to missing %q\n", l.name, l.target)
+	}
+
+	indexed := make([]archiveEntry, 0, len(byName))
+	for _, e := range byName {
+		indexed = append(indexed, e)
+	}
+	sort.Slice(indexed, func(i, j int) bool { return indexed[i].Name < indexed[j].Name })
+	return indexed
+}
+
+// isSparse reports whether hdr is a PAX sparse file, whose content in the
+// archive isn't stored contiguously
+func isSparse(hdr *tar.Header) bool {
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// IsArchive reports whether dir was written by TGZArchive
+func IsArchive(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, IndexFile))
+	return err == nil
+}
+
+// Archive is a read-only file system of the files in a directory written
+// by TGZArchive. Files are read from the tarball at their indexed offsets.
+// It is safe for concurrent use.
+type Archive struct {
+	f        *os.File
+	entries  map[string]*archiveEntry
+	children map[string][]fs.DirEntry
+}
+
+// OpenArchive opens the archive in dir
+func OpenArchive(dir string) (*Archive, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, IndexFile))
+	if err != nil {
+		return nil, err
+	}
+	var entries []archiveEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filepath.Join(dir, ArchiveFile))
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Archive{
+		f:        f,
+		entries:  map[string]*archiveEntry{".": {Name: ".", Mode: fs.ModeDir | 0755}},
+		children: make(map[string][]fs.DirEntry),
+	}
+	for i := range entries {
+		if fs.ValidPath(entries[i].Name) && entries[i].Name != "." {
+			a.add(&entries[i])
+		}
+	}
+	for _, children := range a.children {
+		sort.Slice(children, func(i, j int) bool { return children[i].Name() < children[j].Name() })
+	}
+	return a, nil
+}
+
+// add adds e and any of its parent directories that aren't indexed
+func (a *Archive) add(e *archiveEntry) {
+	if existing, ok := a.entries[e.Name]; ok {
+		*existing = *e // An implicit directory added for an earlier entry
+		return
+	}
+	a.entries[e.Name] = e
+
+	parent := path.Dir(e.Name)
+	a.children[parent] = append(a.children[parent], entryInfo{e})
+	if _, ok := a.entries[parent]; !ok {
+		a.add(&archiveEntry{Name: parent, Mode: fs.ModeDir | 0755})
+	}
+}
+
+// Open opens the file or directory name
+func (a *Archive) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	e, ok := a.entries[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	if e.Mode.IsDir() {
+		return &archiveDir{entryInfo: entryInfo{e}, children: a.children[name]}, nil
+	}
+	return &archiveFile{SectionReader: io.NewSectionReader(a.f, e.Offset, e.Size), entryInfo: entryInfo{e}}, nil
+}
+
+// Close closes the tarball. Files opened from a must not be used after.
+func (a *Archive) Close() error {
+	return a.f.Close()
+}
+
+// entryInfo describes an archive entry as an fs.FileInfo and fs.DirEntry
+type entryInfo struct {
+	e *archiveEntry
+}
+
+func (i entryInfo) Name() string               { return path.Base(i.e.Name) }
+func (i entryInfo) Size() int64                { return i.e.Size }
+func (i entryInfo) Mode() fs.FileMode          { return i.e.Mode }
+func (i entryInfo) ModTime() time.Time         { return i.e.ModTime }
+func (i entryInfo) IsDir() bool                { return i.e.Mode.IsDir() }
+func (i entryInfo) Sys() interface{}           { return nil }
+func (i entryInfo) Type() fs.FileMode          { return i.e.Mode.Type() }
+func (i entryInfo) Info() (fs.FileInfo, error) { return i, nil }
+
+// archiveFile is a file opened from an Archive
+type archiveFile struct {
+	*io.SectionReader
+	entryInfo
+}
+
+func (f *archiveFile) Stat() (fs.FileInfo, error) { return f.entryInfo, nil }
+func (f *archiveFile) Close() error               { return nil }
+
+// archiveDir is a directory opened from an Archive
+type archiveDir struct {
+	entryInfo
+	children []fs.DirEntry
+	offset   int
+}
+
+func (d *archiveDir) Stat() (fs.FileInfo, error) { return d.entryInfo, nil }
+func (d *archiveDir) Close() error               { return nil }
+
+func (d *archiveDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.e.Name, Err: errors.New("is a directory")}
+}
+
+// ReadDir returns the next n entries of d, or all remaining if n <= 0
+func (d *archiveDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.children[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.children)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.offset += n
+	return rest[:n], nil
+}
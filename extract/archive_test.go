@@ -0,0 +1,177 @@
+package extract
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestTGZArchive(t *testing.T) {
+	parent, dest := tempDir(t)
+	defer os.RemoveAll(parent)
+
+	longName := "package/" + strings.Repeat("long/", 30) + "file.js"
+	archive := makeTGZ(t, []testEntry{
+		{name: "pax_global_header", typeflag: tar.TypeXGlobalHeader, body: "global"},
+		{name: "package/", typeflag: tar.TypeDir, mode: 0755},
+		{name: "package/bin/", typeflag: tar.TypeDir, mode: 0750},
+		{name: "package/bin/cli.js", body: "#!/usr/bin/env node", mode: 0755},
+		{name: "package/lib/index.js", body: "index"},
+		{name: "package/empty/", typeflag: tar.TypeDir, mode: 0755},
+		{name: "package/main.js", typeflag: tar.TypeSymlink, linkname: "lib/index.js"},
+		{name: "package/lib/up.js", typeflag: tar.TypeSymlink, linkname: "../bin/cli.js"},
+		{name: "package/chain.js", typeflag: tar.TypeSymlink, linkname: "main.js"},
+		{name: "package/libdir", typeflag: tar.TypeSymlink, linkname: "lib"},
+		{name: "package/escape", typeflag: tar.TypeSymlink, linkname: "../../outside"},
+		{name: "package/absolute", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"},
+		{name: "package/hard.js", typeflag: tar.TypeLink, linkname: "package/lib/index.js"},
+		{name: "package/hard-escape", typeflag: tar.TypeLink, linkname: "package/../../outside"},
+		{name: "package/fifo", typeflag: tar.TypeFifo},
+		{name: longName, body: "pax", format: tar.FormatPAX},
+		{name: "package/lib/index.js", body: "replaced"},
+	})
+	if err := TGZArchive(archive, dest); err != nil {
+		t.Fatal(err)
+	}
+	if !IsArchive(dest) {
+		t.Error("IsArchive() = false")
+	}
+
+	a, err := OpenArchive(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	long := strings.TrimPrefix(longName, "package/")
+	files := map[string]string{
+		"bin/cli.js":   "#!/usr/bin/env node",
+		"lib/index.js": "replaced",
+		"lib/up.js":    "#!/usr/bin/env node",
+		"main.js":      "replaced",
+		"chain.js":     "replaced",
+		"hard.js":      "replaced",
+		long:           "pax",
+	}
+	var names []string
+	for name, want := range files {
+		names = append(names, name)
+		b, err := fs.ReadFile(a, name)
+		if err != nil || string(b) != want {
+			t.Errorf("%s = %q, %v, want %q", name, b, err, want)
+		}
+	}
+	if err := fstest.TestFS(a, append(names, "empty")...); err != nil {
+		t.Error(err)
+	}
+
+	fi, err := fs.Stat(a, "bin")
+	if err != nil || !fi.IsDir() || fi.Mode().Perm() != 0750 {
+		t.Errorf("bin = %v, %v, want directory with 0750", fi, err)
+	}
+	for _, name := range []string{"libdir", "escape", "absolute", "hard-escape", "fifo", "pax_global_header", "../package.tar"} {
+		if _, err := fs.Stat(a, name); err == nil {
+			t.Errorf("%s should have been skipped", name)
+		}
+	}
+
+	// The uncompressed tarball is kept as is
+	f, err := os.Open(filepath.Join(dest, ArchiveFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	n := 0
+	for {
+		if _, err := tr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	if n != 17 {
+		t.Errorf("tarball has %d entries, want 17", n)
+	}
+}
+
+func TestTGZArchiveUnsafePaths(t *testing.T) {
+	for label, name := range unsafeTests {
+		t.Run(label, func(t *testing.T) {
+			parent, dest := tempDir(t)
+			defer os.RemoveAll(parent)
+
+			archive := makeTGZ(t, []testEntry{
+				{name: "package/index.js", body: "ok"},
+				{name: name, body: "escaped"},
+			})
+			if err := TGZArchive(archive, dest); err != ErrUnsafePath {
+				t.Errorf("TGZArchive() error = %v, want %v", err, ErrUnsafePath)
+			}
+		})
+	}
+}
+
+func TestTGZArchiveRoot(t *testing.T) {
+	for label, tt := range rootTests {
+		t.Run(label, func(t *testing.T) {
+			parent, dest := tempDir(t)
+			defer os.RemoveAll(parent)
+
+			var entries []testEntry
+			for _, name := range tt.entries {
+				entries = append(entries, testEntry{name: name, body: name})
+			}
+			if err := TGZArchive(makeTGZ(t, entries), dest); err != nil {
+				t.Fatal(err)
+			}
+			a, err := OpenArchive(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer a.Close()
+
+			var got []string
+			err = fs.WalkDir(a, ".", func(p string, d fs.DirEntry, err error) error {
+				if err == nil && d.Type().IsRegular() {
+					got = append(got, p)
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sort.Strings(got)
+			want := append([]string(nil), tt.want...)
+			sort.Strings(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("indexed %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestOpenArchiveMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if IsArchive(dir) {
+		t.Error("IsArchive() of empty directory = true")
+	}
+	if _, err := OpenArchive(dir); !os.IsNotExist(err) {
+		t.Errorf("OpenArchive() error = %v, want not exist", err)
+	}
+}
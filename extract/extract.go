@@ -3,20 +3,39 @@ package extract
 import (
 	"archive/tar"
 	"compress/gzip"
+	"errors"
 	"io"
+	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
 )
 
+// ErrUnsafePath is returned when an archive entry would be extracted outside
+// of the destination directory
+var ErrUnsafePath = errors.New("unsafe path in archive")
+
 // TGZ extracts tar/gzipped files.
 //
-// NPM puts all files in a package directory. This implementation strips off the
-// package portion.
-func TGZ(r io.Reader, dir string) error {
+// NPM puts all files in a single top-level directory, usually "package". This
+// implementation strips off that directory. If entries aren't all within a
+// single directory they are extracted as is.
+//
+// Entries with absolute paths or ".." components, or that would be extracted
+// through a previously extracted symlink, are rejected with ErrUnsafePath, as
+// packages are untrusted. Symlinks that resolve outside of dir once all
+// entries are extracted are removed.
+func TGZ(r io.Reader, dir string) (err error) {
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return err
 	}
+	// Also when extraction fails, as the entries so far remain
+	defer func() {
+		if lerr := removeEscapingLinks(dir); err == nil {
+			err = lerr
+		}
+	}()
 
 	gr, err := gzip.NewReader(r)
 	if err != nil {
@@ -25,6 +44,7 @@ func TGZ(r io.Reader, dir string) error {
 
 	tr := tar.NewReader(gr)
 
+	var root rootDir
 	for {
 		hdr, err := tr.Next()
 		if err == io.EOF {
@@ -33,12 +53,129 @@ func TGZ(r io.Reader, dir string) error {
 		if err != nil {
 			return err
 		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			// Global PAX headers only carry metadata
+			continue
+		}
 
-		fullpath := filepath.Join(dir, strings.TrimPrefix(hdr.Name, "package"))
+		if isAbs(hdr.Name) {
+			return ErrUnsafePath
+		}
+		name := strings.TrimPrefix(hdr.Name, "./")
 
-		os.MkdirAll(filepath.Dir(fullpath), 0755)
+		if !root.detected {
+			root.detect(name, hdr.Typeflag == tar.TypeDir)
+		}
+		rel, ok := root.strip(name)
+		if !ok {
+			// Not all entries share the root, so it is part of their paths.
+			// Move the entries extracted so far back into it.
+			if err := unstrip(dir, root.name); err != nil {
+				return err
+			}
+			root.name = ""
+			rel = name
+		}
 
-		f, err := os.OpenFile(fullpath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, hdr.FileInfo().Mode())
+		fullpath, err := safeJoin(dir, rel)
+		if err != nil {
+			return err
+		}
+
+		if err := extractEntry(tr, hdr, dir, fullpath, &root); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rootDir is the top-level directory stripped from archive entries
+type rootDir struct {
+	name     string // empty if entries are not stripped
+	detected bool
+}
+
+// detect sets the root from the first entry name in the archive
+func (r *rootDir) detect(name string, isDir bool) {
+	r.detected = true
+
+	i := strings.IndexByte(name, '/')
+	switch {
+	case i >= 0:
+		r.name = name[:i]
+	case isDir:
+		r.name = name
+	}
+	if r.name == "." || r.name == ".." {
+		r.name = ""
+	}
+}
+
+// strip returns name relative to the root, or false if it's outside it
+func (r *rootDir) strip(name string) (string, bool) {
+	switch {
+	case r.name == "":
+		return name, true
+	case name == r.name:
+		return "", true
+	case strings.HasPrefix(name, r.name+"/"):
+		return name[len(r.name)+1:], true
+	}
+	return "", false
+}
+
+// unstrip moves the contents of dir into the directory root within it
+func unstrip(dir, root string) error {
+	tmp, err := ioutil.TempDir(dir, ".root")
+	if err != nil {
+		return err
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range infos {
+		if p := filepath.Join(dir, fi.Name()); p != tmp {
+			if err := os.Rename(p, filepath.Join(tmp, fi.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	fullpath, err := safeJoin(dir, root)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, fullpath)
+}
+
+// extractEntry creates fullpath from the entry hdr. Links are only created
+// if their target is within dir, otherwise they are skipped.
+//
+// PAX and GNU long name headers are merged into hdr by the tar reader.
+func extractEntry(tr *tar.Reader, hdr *tar.Header, dir, fullpath string, root *rootDir) error {
+	mode := hdr.FileInfo().Mode().Perm()
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if fi, err := os.Lstat(fullpath); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			os.Remove(fullpath) // Don't create the directory through a link
+		}
+		// The owner must be able to write to the directory to extract into it
+		if err := os.MkdirAll(fullpath, mode|0700); err != nil {
+			return err
+		}
+		return os.Chmod(fullpath, mode|0700)
+	case tar.TypeReg, tar.TypeRegA:
+		if err := os.MkdirAll(filepath.Dir(fullpath), 0755); err != nil {
+			return err
+		}
+		os.Remove(fullpath) // Don't write through a previously extracted link
+
+		// The owner must be able to read the file to serve it
+		f, err := os.OpenFile(fullpath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode|0600)
 		if err != nil {
 			return err
 		}
@@ -46,8 +183,104 @@ func TGZ(r io.Reader, dir string) error {
 			f.Close()
 			return err
 		}
-		f.Close()
+		return f.Close()
+	case tar.TypeSymlink:
+		if isAbs(hdr.Linkname) || !within(dir, filepath.Join(filepath.Dir(fullpath), hdr.Linkname)) {
+			log.Printf("Skipping symlink %q to %q outside of package\n", hdr.Name, hdr.Linkname)
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(fullpath), 0755); err != nil {
+			return err
+		}
+		os.Remove(fullpath)
+		if err := os.Symlink(filepath.FromSlash(hdr.Linkname), fullpath); err != nil {
+			log.Printf("Skipping symlink %q: %v\n", hdr.Name, err)
+		}
+		return nil
+	case tar.TypeLink:
+		rel, ok := root.strip(strings.TrimPrefix(hdr.Linkname, "./"))
+		target, err := safeJoin(dir, rel)
+		if isAbs(hdr.Linkname) || !ok || err != nil {
+			log.Printf("Skipping hardlink %q to %q outside of package\n", hdr.Name, hdr.Linkname)
+			return nil
+		}
+		if fi, err := os.Lstat(target); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			// The linked symlink would resolve relative to fullpath instead
+			log.Printf("Skipping hardlink %q to symlink %q\n", hdr.Name, hdr.Linkname)
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(fullpath), 0755); err != nil {
+			return err
+		}
+		os.Remove(fullpath)
+		if err := os.Link(target, fullpath); err != nil {
+			log.Printf("Skipping hardlink %q: %v\n", hdr.Name, err)
+		}
+		return nil
+	default:
+		log.Printf("Skipping %q with unsupported type %q\n", hdr.Name, hdr.Typeflag)
+		return nil
 	}
+}
 
-	return nil
+// isAbs reports whether the archive entry name is an absolute path on
+// any platform
+func isAbs(name string) bool {
+	return strings.HasPrefix(name, "/") || strings.HasPrefix(name, `\`) || filepath.VolumeName(name) != ""
+}
+
+// safeJoin joins dir and the relative archive entry name, returning
+// ErrUnsafePath if the result would not be within dir. Parent directories
+// that already exist are checked on disk, so that the result can't be
+// reached through a symlink; the last element may still be one.
+func safeJoin(dir, name string) (string, error) {
+	for _, part := range strings.FieldsFunc(name, isSeparator) {
+		if part == ".." {
+			return "", ErrUnsafePath
+		}
+	}
+
+	dir = filepath.Clean(dir)
+	fullpath := filepath.Join(dir, name)
+	if !within(dir, fullpath) {
+		return "", ErrUnsafePath
+	}
+
+	for p := filepath.Dir(fullpath); p != dir && within(dir, p); p = filepath.Dir(p) {
+		fi, err := os.Lstat(p)
+		if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return "", ErrUnsafePath
+		}
+	}
+	return fullpath, nil
+}
+
+// removeEscapingLinks removes symlinks within dir that don't resolve to a
+// path within it. Links are checked against entry names as they're
+// extracted, but later entries can change where they resolve to on disk.
+func removeEscapingLinks(dir string) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			return err
+		}
+		if target, err := filepath.EvalSymlinks(p); err == nil && within(root, target) {
+			return nil
+		}
+		log.Printf("Removing symlink %q resolving outside of package\n", p)
+		return os.Remove(p)
+	})
+}
+
+// within reports whether p is dir or a path within it
+func within(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func isSeparator(r rune) bool {
+	return r == '/' || r == '\\'
 }
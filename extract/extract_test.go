@@ -0,0 +1,384 @@
+package extract
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testEntry is a tar entry for building test archives
+type testEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+	mode     int64
+	format   tar.Format
+}
+
+// makeTGZ builds a tar/gzipped archive of entries
+func makeTGZ(t *testing.T, entries []testEntry) *bytes.Buffer {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Size:     int64(len(e.body)),
+			Mode:     e.mode,
+			Format:   e.format,
+		}
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			hdr = &tar.Header{
+				Name:       e.name,
+				Typeflag:   tar.TypeXGlobalHeader,
+				PAXRecords: map[string]string{"comment": e.body},
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body[:hdr.Size])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// tempDir creates a temporary directory containing the extraction
+// directory "dest", so that escapes can be detected in the parent
+func tempDir(t *testing.T) (parent, dest string) {
+	parent, err := ioutil.TempDir("", "extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parent, filepath.Join(parent, "dest")
+}
+
+var unsafeTests = map[string]string{
+	"parent":             "package/../../escaped",
+	"nested parent":      "package/lib/../../../escaped",
+	"bare parent":        "../escaped",
+	"absolute":           "/tmp/escaped",
+	"backslash absolute": `\escaped`,
+	"backslash parent":   `package\..\..\escaped`,
+}
+
+func TestTGZUnsafePaths(t *testing.T) {
+	for label, name := range unsafeTests {
+		t.Run(label, func(t *testing.T) {
+			parent, dest := tempDir(t)
+			defer os.RemoveAll(parent)
+
+			archive := makeTGZ(t, []testEntry{
+				{name: "package/index.js", body: "ok"},
+				{name: name, body: "escaped"},
+			})
+			if err := TGZ(archive, dest); err != ErrUnsafePath {
+				t.Errorf("TGZ() error = %v, want %v", err, ErrUnsafePath)
+			}
+
+			if _, err := os.Stat(filepath.Join(parent, "escaped")); !os.IsNotExist(err) {
+				t.Errorf("entry %q was extracted outside of the destination", name)
+			}
+		})
+	}
+}
+
+func TestSafeJoinSymlinkParent(t *testing.T) {
+	parent, dest := tempDir(t)
+	defer os.RemoveAll(parent)
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(parent, filepath.Join(dest, "lib")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"lib/escaped", "lib/nested/escaped"} {
+		if _, err := safeJoin(dest, name); err != ErrUnsafePath {
+			t.Errorf("safeJoin(%q) error = %v, want %v", name, err, ErrUnsafePath)
+		}
+	}
+	if _, err := safeJoin(dest, "lib"); err != nil {
+		t.Errorf("safeJoin(%q) error = %v, want nil", "lib", err)
+	}
+
+	// A regular file entry below the symlinked directory
+	archive := makeTGZ(t, []testEntry{
+		{name: "package/index.js", body: "ok"},
+		{name: "package/lib/escaped", body: "escaped"},
+	})
+	if err := TGZ(archive, dest); err != ErrUnsafePath {
+		t.Errorf("TGZ() error = %v, want %v", err, ErrUnsafePath)
+	}
+	if _, err := os.Stat(filepath.Join(parent, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("file was written through the symlinked directory")
+	}
+}
+
+func TestTGZ(t *testing.T) {
+	parent, dest := tempDir(t)
+	defer os.RemoveAll(parent)
+
+	archive := makeTGZ(t, []testEntry{
+		{name: "package/package.json", body: "{}"},
+		{name: "package/lib/index.js", body: "module.exports = 1"},
+		{name: "package/lib/..hidden.js", body: "dots in names are fine"},
+	})
+	if err := TGZ(archive, dest); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"package.json":    "{}",
+		"lib/index.js":    "module.exports = 1",
+		"lib/..hidden.js": "dots in names are fine",
+	}
+	for name, content := range want {
+		b, err := ioutil.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("reading %s: %v", name, err)
+			continue
+		}
+		if string(b) != content {
+			t.Errorf("%s = %q, want %q", name, b, content)
+		}
+	}
+}
+
+func TestTGZEntryTypes(t *testing.T) {
+	parent, dest := tempDir(t)
+	defer os.RemoveAll(parent)
+
+	longName := "package/" + strings.Repeat("long/", 30) + "file.js"
+	archive := makeTGZ(t, []testEntry{
+		{name: "pax_global_header", typeflag: tar.TypeXGlobalHeader, body: "global"},
+		{name: "package/", typeflag: tar.TypeDir, mode: 0755},
+		{name: "package/bin/", typeflag: tar.TypeDir, mode: 0750},
+		{name: "package/bin/cli.js", body: "#!/usr/bin/env node", mode: 0755},
+		{name: "package/lib/index.js", body: "index"},
+		{name: "package/main.js", typeflag: tar.TypeSymlink, linkname: "lib/index.js"},
+		{name: "package/lib/up.js", typeflag: tar.TypeSymlink, linkname: "../bin/cli.js"},
+		{name: "package/escape", typeflag: tar.TypeSymlink, linkname: "../../outside"},
+		{name: "package/absolute", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"},
+		{name: "package/hard.js", typeflag: tar.TypeLink, linkname: "package/lib/index.js"},
+		{name: "package/hard-escape", typeflag: tar.TypeLink, linkname: "package/../../outside"},
+		{name: "package/fifo", typeflag: tar.TypeFifo},
+		{name: longName, body: "pax", format: tar.FormatPAX},
+		{name: longName + ".gnu", body: "gnu", format: tar.FormatGNU},
+	})
+	if err := TGZ(archive, dest); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(filepath.Join(dest, "bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.IsDir() || fi.Mode().Perm() != 0750 {
+		t.Errorf("bin mode = %v, want directory with 0750", fi.Mode())
+	}
+
+	fi, err = os.Stat(filepath.Join(dest, "bin", "cli.js"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0755 {
+		t.Errorf("cli.js mode = %v, want 0755", fi.Mode())
+	}
+
+	for name, want := range map[string]string{
+		"main.js":                                "index",
+		"lib/up.js":                              "#!/usr/bin/env node",
+		"hard.js":                                "index",
+		strings.TrimPrefix(longName, "package/"): "pax",
+		strings.TrimPrefix(longName, "package/") + ".gnu": "gnu",
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("reading %s: %v", name, err)
+			continue
+		}
+		if string(b) != want {
+			t.Errorf("%s = %q, want %q", name, b, want)
+		}
+	}
+
+	if fi, err := os.Lstat(filepath.Join(dest, "main.js")); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("main.js is not a symlink")
+	}
+
+	for _, name := range []string{"escape", "absolute", "hard-escape", "fifo", "pax_global_header"} {
+		if _, err := os.Lstat(filepath.Join(dest, name)); !os.IsNotExist(err) {
+			t.Errorf("%s should have been skipped", name)
+		}
+	}
+}
+
+var linkChainTests = map[string]struct {
+	entries []testEntry
+	wantErr error
+}{
+	"chained symlinks": {
+		entries: []testEntry{
+			{name: "package/a", typeflag: tar.TypeSymlink, linkname: "."},
+			{name: "package/a/b", typeflag: tar.TypeSymlink, linkname: ".."},
+			{name: "package/b/escaped.txt", body: "escaped"},
+		},
+		wantErr: ErrUnsafePath,
+	},
+	"symlink through symlink": {
+		entries: []testEntry{
+			{name: "package/a", typeflag: tar.TypeSymlink, linkname: "."},
+			{name: "package/b", typeflag: tar.TypeSymlink, linkname: "a/.."},
+		},
+	},
+	"file through symlink through symlink": {
+		entries: []testEntry{
+			{name: "package/a", typeflag: tar.TypeSymlink, linkname: "."},
+			{name: "package/b", typeflag: tar.TypeSymlink, linkname: "a/.."},
+			{name: "package/b/escaped.txt", body: "escaped"},
+		},
+		wantErr: ErrUnsafePath,
+	},
+	"hardlinked symlink": {
+		entries: []testEntry{
+			{name: "package/lib/up", typeflag: tar.TypeSymlink, linkname: ".."},
+			{name: "package/b", typeflag: tar.TypeLink, linkname: "package/lib/up"},
+			{name: "package/b/escaped.txt", body: "escaped"},
+		},
+	},
+	"hardlink through symlink": {
+		entries: []testEntry{
+			{name: "package/a", typeflag: tar.TypeSymlink, linkname: "."},
+			{name: "package/a/b", typeflag: tar.TypeLink, linkname: "package/a/a"},
+		},
+		wantErr: ErrUnsafePath,
+	},
+}
+
+func TestTGZLinkChains(t *testing.T) {
+	for label, tt := range linkChainTests {
+		t.Run(label, func(t *testing.T) {
+			parent, dest := tempDir(t)
+			defer os.RemoveAll(parent)
+
+			if err := TGZ(makeTGZ(t, tt.entries), dest); err != tt.wantErr {
+				t.Errorf("TGZ() error = %v, want %v", err, tt.wantErr)
+			}
+
+			infos, err := ioutil.ReadDir(parent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(infos) != 1 {
+				t.Errorf("%d entries extracted outside of the destination", len(infos)-1)
+			}
+
+			root, err := filepath.EvalSymlinks(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			filepath.Walk(dest, func(p string, fi os.FileInfo, err error) error {
+				if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+					if target, err := filepath.EvalSymlinks(p); err != nil || !within(root, target) {
+						t.Errorf("symlink %s resolves outside of the destination", p)
+					}
+				}
+				return err
+			})
+		})
+	}
+}
+
+var rootTests = map[string]struct {
+	entries []string
+	want    []string
+}{
+	"package": {
+		entries: []string{"package/package.json", "package/lib/index.js"},
+		want:    []string{"package.json", "lib/index.js"},
+	},
+	"other root": {
+		entries: []string{"node/package.json", "node/index.d.ts"},
+		want:    []string{"package.json", "index.d.ts"},
+	},
+	"dot slash": {
+		entries: []string{"./package/package.json", "./package/index.js"},
+		want:    []string{"package.json", "index.js"},
+	},
+	"similar prefix": {
+		entries: []string{"package/package.json", "packages-extra/x.js"},
+		want:    []string{"package/package.json", "packages-extra/x.js"},
+	},
+	"root named like child": {
+		entries: []string{"package/package/index.js", "other.js"},
+		want:    []string{"package/package/index.js", "other.js"},
+	},
+	"top level": {
+		entries: []string{"package.json", "lib/index.js"},
+		want:    []string{"package.json", "lib/index.js"},
+	},
+}
+
+func TestTGZRoot(t *testing.T) {
+	for label, tt := range rootTests {
+		t.Run(label, func(t *testing.T) {
+			parent, dest := tempDir(t)
+			defer os.RemoveAll(parent)
+
+			var entries []testEntry
+			for _, name := range tt.entries {
+				entries = append(entries, testEntry{name: name, body: name})
+			}
+			if err := TGZ(makeTGZ(t, entries), dest); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			err := filepath.Walk(dest, func(p string, fi os.FileInfo, err error) error {
+				if err == nil && fi.Mode().IsRegular() {
+					rel, _ := filepath.Rel(dest, p)
+					got = append(got, filepath.ToSlash(rel))
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sort.Strings(got)
+			want := append([]string(nil), tt.want...)
+			sort.Strings(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("extracted %q, want %q", got, want)
+			}
+		})
+	}
+}
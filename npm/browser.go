@@ -0,0 +1,107 @@
+package npm
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+)
+
+// Browser is the package.json browser field.
+//
+// It is either a string replacing main, or an object mapping files and
+// modules to their replacements. Files excluded with false map to "".
+type Browser struct {
+	Main string
+	// Map keys and values referring to files within the package are
+	// normalized to absolute paths, eg. "./lib/node.js" to "/lib/node.js".
+	// Module names are left as is.
+	Map map[string]string
+}
+
+// UnmarshalJSON decodes either form of the browser field
+func (b *Browser) UnmarshalJSON(data []byte) error {
+	var main string
+	if err := json.Unmarshal(data, &main); err == nil {
+		*b = Browser{Main: main}
+		return nil
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		// Invalid values are ignored rather than failing the whole package
+		*b = Browser{}
+		return nil
+	}
+
+	*b = Browser{Map: make(map[string]string, len(m))}
+	for k, v := range m {
+		switch v := v.(type) {
+		case string:
+			b.Map[normalizeFile(k)] = normalizeFile(v)
+		case bool:
+			if !v {
+				b.Map[normalizeFile(k)] = ""
+			}
+		}
+	}
+	return nil
+}
+
+// MarshalJSON encodes b in the package.json form
+func (b Browser) MarshalJSON() ([]byte, error) {
+	if b.Map == nil {
+		return json.Marshal(b.Main)
+	}
+
+	m := make(map[string]interface{}, len(b.Map))
+	for k, v := range b.Map {
+		if v == "" {
+			m[denormalizeFile(k)] = false
+			continue
+		}
+		m[denormalizeFile(k)] = denormalizeFile(v)
+	}
+	return json.Marshal(m)
+}
+
+// Resolve applies the browser map to file, an absolute path within the
+// package. It returns the path to serve, or false if the file is excluded
+// from browser builds.
+func (b *Browser) Resolve(file string) (string, bool) {
+	key := path.Clean("/" + strings.TrimPrefix(file, "./"))
+	for _, key := range []string{key, key + ".js", strings.TrimSuffix(key, ".js")} {
+		replacement, ok := b.Map[key]
+		switch {
+		case !ok:
+			continue
+		case replacement == "":
+			return "", false
+		case strings.HasPrefix(replacement, "/"):
+			return replacement, true
+		}
+	}
+	return file, true
+}
+
+// isRelative reports whether a browser map entry refers to a file rather
+// than a module
+func isRelative(s string) bool {
+	return s == "." || s == ".." || strings.HasPrefix(s, "./") || strings.HasPrefix(s, "../")
+}
+
+// normalizeFile converts relative file references to absolute paths
+// within the package
+func normalizeFile(s string) string {
+	if !isRelative(s) {
+		return s
+	}
+	return path.Clean("/" + s)
+}
+
+// denormalizeFile reverses normalizeFile
+func denormalizeFile(s string) string {
+	if !strings.HasPrefix(s, "/") {
+		return s
+	}
+	return "." + s
+}
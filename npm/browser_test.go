@@ -0,0 +1,83 @@
+package npm
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestBrowserUnmarshal(t *testing.T) {
+	var p struct{ Browser Browser }
+	err := json.Unmarshal([]byte(`{"browser": {
+		"./lib/node.js": "./lib/browser.js",
+		"./lib/server": false,
+		"fs": false,
+		"http": "stream-http",
+		"./lib/ignored.js": true
+	}}`), &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Browser{Map: map[string]string{
+		"/lib/node.js": "/lib/browser.js",
+		"/lib/server":  "",
+		"fs":           "",
+		"http":         "stream-http",
+	}}
+	if !reflect.DeepEqual(p.Browser, want) {
+		t.Errorf("Browser = %+v, want %+v", p.Browser, want)
+	}
+
+	b, err := json.Marshal(p.Browser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var roundTrip Browser
+	if err := json.Unmarshal(b, &roundTrip); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(roundTrip, want) {
+		t.Errorf("round trip Browser = %+v, want %+v", roundTrip, want)
+	}
+}
+
+func TestBrowserUnmarshalString(t *testing.T) {
+	var b Browser
+	if err := json.Unmarshal([]byte(`"dist/browser.js"`), &b); err != nil {
+		t.Fatal(err)
+	}
+	if want := (Browser{Main: "dist/browser.js"}); !reflect.DeepEqual(b, want) {
+		t.Errorf("Browser = %+v, want %+v", b, want)
+	}
+}
+
+var browserResolveTests = map[string]struct {
+	in   string
+	want string
+	ok   bool
+}{
+	"replaced":           {in: "/lib/node.js", want: "/lib/browser.js", ok: true},
+	"replaced main":      {in: "./lib/node.js", want: "/lib/browser.js", ok: true},
+	"replaced no ext":    {in: "lib/node", want: "/lib/browser.js", ok: true},
+	"excluded":           {in: "/lib/server.js", ok: false},
+	"unmapped":           {in: "/lib/util.js", want: "/lib/util.js", ok: true},
+	"module not applied": {in: "/fs", want: "/fs", ok: true},
+}
+
+func TestBrowserResolve(t *testing.T) {
+	b := Browser{Map: map[string]string{
+		"/lib/node.js": "/lib/browser.js",
+		"/lib/server":  "",
+		"fs":           "",
+	}}
+
+	for label, tt := range browserResolveTests {
+		t.Run(label, func(t *testing.T) {
+			got, ok := b.Resolve(tt.in)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("Resolve(%s) = %q, %t, want %q, %t", tt.in, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package npm
+
+import (
+	"encoding/json"
+	"errors"
+	"path"
+	"strings"
+)
+
+// ErrNotExported is returned when a subpath is not exported by a package
+var ErrNotExported = errors.New("subpath not exported by package")
+
+// DefaultConditions are the export conditions used when resolving for
+// browsers, in order of priority
+var DefaultConditions = []string{"browser", "import"}
+
+// ResolveExport resolves subpath, "." for the package itself or "./name",
+// using the package.json exports field.
+//
+// Conditions are matched in the order given, rather than the order they
+// appear in package.json, with "default" always matching last. The
+// returned path is absolute within the package.
+func (p *Package) ResolveExport(subpath string, conditions []string) (string, error) {
+	if len(p.Exports) == 0 {
+		return "", ErrNotExported
+	}
+
+	subpaths, err := exportSubpaths(p.Exports)
+	if err != nil {
+		return "", err
+	}
+
+	if target, ok := subpaths[subpath]; ok && !strings.Contains(subpath, "*") {
+		return resolveTarget(target, "", false, conditions)
+	}
+
+	// Find the most specific pattern ("./x/*") or directory ("./x/") match
+	var (
+		bestKey   string
+		bestMatch string
+	)
+	for key := range subpaths {
+		var match string
+		if i := strings.IndexByte(key, '*'); i >= 0 {
+			prefix, suffix := key[:i], key[i+1:]
+			if len(subpath) < len(key)-1 || !strings.HasPrefix(subpath, prefix) || !strings.HasSuffix(subpath, suffix) {
+				continue
+			}
+			match = subpath[len(prefix) : len(subpath)-len(suffix)]
+		} else if strings.HasSuffix(key, "/") && strings.HasPrefix(subpath, key) {
+			match = subpath[len(key):]
+		} else {
+			continue
+		}
+		if bestKey == "" || patternLess(key, bestKey) {
+			bestKey, bestMatch = key, match
+		}
+	}
+	if bestKey == "" {
+		return "", ErrNotExported
+	}
+
+	// Directory mappings ("./x/") append the remainder to the target
+	isDir := !strings.Contains(bestKey, "*")
+	return resolveTarget(subpaths[bestKey], bestMatch, isDir, conditions)
+}
+
+// IsExportTarget reports whether file, absolute within the package, is the
+// target of a subpath exported for conditions, so that its canonical URL
+// can be requested as is.
+func (p *Package) IsExportTarget(file string, conditions []string) bool {
+	if len(p.Exports) == 0 {
+		return false
+	}
+	subpaths, err := exportSubpaths(p.Exports)
+	if err != nil {
+		return false
+	}
+
+	for key, target := range subpaths {
+		switch {
+		case strings.Contains(key, "*"):
+			pattern, err := resolveTarget(target, "*", false, conditions)
+			if err != nil {
+				continue
+			}
+			i := strings.IndexByte(pattern, '*')
+			if i < 0 {
+				if file == pattern {
+					return true
+				}
+				continue
+			}
+			prefix, suffix := pattern[:i], pattern[i+1:]
+			if len(file) > len(prefix)+len(suffix) && strings.HasPrefix(file, prefix) && strings.HasSuffix(file, suffix) {
+				return true
+			}
+		case strings.HasSuffix(key, "/"):
+			dir, err := resolveTarget(target, "", true, conditions)
+			if err == nil && strings.HasPrefix(file, strings.TrimSuffix(dir, "/")+"/") {
+				return true
+			}
+		default:
+			if f, err := resolveTarget(target, "", false, conditions); err == nil && file == f {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// patternLess reports whether pattern key a is more specific than b.
+//
+// Longer prefixes before the wildcard are more specific, followed by
+// longer keys.
+func patternLess(a, b string) bool {
+	ai, bi := strings.IndexByte(a, '*'), strings.IndexByte(b, '*')
+	if ai < 0 {
+		ai = len(a)
+	}
+	if bi < 0 {
+		bi = len(b)
+	}
+	if ai != bi {
+		return ai > bi
+	}
+	return len(a) > len(b)
+}
+
+// exportSubpaths normalizes the exports field to a map of subpaths to
+// targets. Strings, arrays and condition objects export only ".".
+func exportSubpaths(exports json.RawMessage) (map[string]json.RawMessage, error) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(exports, &m); err != nil {
+		// Not an object, shorthand for the main export
+		return map[string]json.RawMessage{".": exports}, nil
+	}
+
+	var subpaths, conditions int
+	for key := range m {
+		if strings.HasPrefix(key, ".") {
+			subpaths++
+		} else {
+			conditions++
+		}
+	}
+	switch {
+	case subpaths > 0 && conditions > 0:
+		return nil, errors.New("invalid exports: mixed subpaths and conditions")
+	case conditions > 0:
+		return map[string]json.RawMessage{".": exports}, nil
+	}
+	return m, nil
+}
+
+// resolveTarget resolves an export target, replacing wildcards with match.
+// If appendMatch is true match is appended to the target instead.
+func resolveTarget(target json.RawMessage, match string, appendMatch bool, conditions []string) (string, error) {
+	var s string
+	if err := json.Unmarshal(target, &s); err == nil {
+		if !strings.HasPrefix(s, "./") {
+			return "", ErrNotExported
+		}
+		if appendMatch {
+			s += match
+		} else {
+			s = strings.Replace(s, "*", match, -1)
+		}
+		for _, seg := range strings.Split(s, "/") {
+			if seg == ".." || seg == "node_modules" {
+				return "", ErrNotExported
+			}
+		}
+		return path.Clean("/" + s), nil
+	}
+
+	var fallbacks []json.RawMessage
+	if err := json.Unmarshal(target, &fallbacks); err == nil {
+		for _, t := range fallbacks {
+			if file, err := resolveTarget(t, match, appendMatch, conditions); err == nil {
+				return file, nil
+			}
+		}
+		return "", ErrNotExported
+	}
+
+	var conds map[string]json.RawMessage
+	if err := json.Unmarshal(target, &conds); err == nil && conds != nil {
+		for i := 0; i <= len(conditions); i++ {
+			c := "default"
+			if i < len(conditions) {
+				c = conditions[i]
+			}
+			t, ok := conds[c]
+			if !ok {
+				continue
+			}
+			if file, err := resolveTarget(t, match, appendMatch, conditions); err == nil {
+				return file, nil
+			}
+		}
+	}
+
+	// null or no matching conditions
+	return "", ErrNotExported
+}
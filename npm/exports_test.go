@@ -0,0 +1,127 @@
+package npm
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const testExports = `{
+	".": {
+		"require": "./dist/index.cjs",
+		"import": "./dist/index.mjs",
+		"browser": {"import": "./dist/browser.mjs", "default": "./dist/browser.js"}
+	},
+	"./feature": ["./missing/../escape.js", "./feature/index.js"],
+	"./features/*": "./src/features/*.js",
+	"./features/internal/*": null,
+	"./utils/*.js": {"import": "./esm/utils/*.js", "default": "./cjs/utils/*.js"},
+	"./legacy/": "./lib/",
+	"./package.json": "./package.json"
+}`
+
+var exportTests = map[string]struct {
+	exports    string
+	subpath    string
+	conditions []string
+	want       string
+	err        error
+}{
+	"string": {
+		exports: `"./index.js"`, subpath: ".", want: "/index.js",
+	},
+	"string subpath": {
+		exports: `"./index.js"`, subpath: "./other", err: ErrNotExported,
+	},
+	"conditions object": {
+		exports: `{"import": "./index.mjs", "default": "./index.js"}`, subpath: ".",
+		conditions: []string{"import"}, want: "/index.mjs",
+	},
+	"condition priority": {
+		exports: testExports, subpath: ".",
+		conditions: []string{"browser", "import"}, want: "/dist/browser.mjs",
+	},
+	"condition priority reversed": {
+		exports: testExports, subpath: ".",
+		conditions: []string{"import", "browser"}, want: "/dist/index.mjs",
+	},
+	"no matching condition": {
+		exports: testExports, subpath: ".",
+		conditions: []string{"node"}, err: ErrNotExported,
+	},
+	"fallback array": {
+		exports: testExports, subpath: "./feature", want: "/feature/index.js",
+	},
+	"pattern": {
+		exports: testExports, subpath: "./features/a/b", want: "/src/features/a/b.js",
+	},
+	"null pattern": {
+		exports: testExports, subpath: "./features/internal/x", err: ErrNotExported,
+	},
+	"pattern with suffix": {
+		exports: testExports, subpath: "./utils/math.js",
+		conditions: []string{"import"}, want: "/esm/utils/math.js",
+	},
+	"pattern default": {
+		exports: testExports, subpath: "./utils/math.js", want: "/cjs/utils/math.js",
+	},
+	"directory": {
+		exports: testExports, subpath: "./legacy/a/b.js", want: "/lib/a/b.js",
+	},
+	"exact": {
+		exports: testExports, subpath: "./package.json", want: "/package.json",
+	},
+	"not exported": {
+		exports: testExports, subpath: "./dist/index.cjs", err: ErrNotExported,
+	},
+	"no exports": {
+		subpath: ".", err: ErrNotExported,
+	},
+}
+
+func TestResolveExport(t *testing.T) {
+	for label, tt := range exportTests {
+		t.Run(label, func(t *testing.T) {
+			p := &Package{Exports: json.RawMessage(tt.exports)}
+			got, err := p.ResolveExport(tt.subpath, tt.conditions)
+			if err != tt.err || got != tt.want {
+				t.Errorf("ResolveExport(%s) = %q, %v, want %q, %v", tt.subpath, got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+var exportTargetTests = map[string]struct {
+	file       string
+	conditions []string
+	want       bool
+}{
+	"main":               {file: "/dist/browser.js", conditions: []string{"browser"}, want: true},
+	"main condition":     {file: "/dist/browser.mjs", conditions: []string{"browser", "import"}, want: true},
+	"main not matched":   {file: "/dist/index.cjs"},
+	"fallback array":     {file: "/feature/index.js", want: true},
+	"pattern":            {file: "/src/features/a/b.js", want: true},
+	"pattern empty":      {file: "/src/features/.js"},
+	"pattern suffix":     {file: "/src/features/a.mjs"},
+	"pattern condition":  {file: "/esm/utils/math.js", conditions: []string{"import"}, want: true},
+	"directory":          {file: "/lib/a/b.js", want: true},
+	"directory itself":   {file: "/lib"},
+	"exact":              {file: "/package.json", want: true},
+	"not a target":       {file: "/README.md"},
+	"directory sibling":  {file: "/library.js"},
+	"pattern wrong root": {file: "/features/a.js"},
+}
+
+func TestIsExportTarget(t *testing.T) {
+	p := &Package{Exports: json.RawMessage(testExports)}
+	for label, tt := range exportTargetTests {
+		t.Run(label, func(t *testing.T) {
+			if got := p.IsExportTarget(tt.file, tt.conditions); got != tt.want {
+				t.Errorf("IsExportTarget(%s) = %t, want %t", tt.file, got, tt.want)
+			}
+		})
+	}
+
+	if (&Package{}).IsExportTarget("/index.js", nil) {
+		t.Error("IsExportTarget() without exports = true")
+	}
+}
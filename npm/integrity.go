@@ -0,0 +1,78 @@
+package npm
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// integrityAlgorithms are the supported Subresource Integrity algorithms,
+// strongest first
+var integrityAlgorithms = []struct {
+	name string
+	new  func() hash.Hash
+}{
+	{"sha512", sha512.New},
+	{"sha384", sha512.New384},
+	{"sha256", sha256.New},
+	{"sha1", sha1.New},
+}
+
+// verifier hashes a download and checks it against the expected digests
+type verifier struct {
+	hash.Hash
+	algorithm string
+	digests   [][]byte
+}
+
+// newVerifier creates a verifier for the strongest algorithm in the
+// Subresource Integrity string, falling back to the hex SHA-1 shasum.
+func newVerifier(integrity, shasum string) (*verifier, error) {
+	digests := make(map[string][][]byte)
+	for _, entry := range strings.Fields(integrity) {
+		i := strings.IndexByte(entry, '-')
+		if i < 0 {
+			continue
+		}
+		algorithm, digest := entry[:i], entry[i+1:]
+		if j := strings.IndexByte(digest, '?'); j >= 0 {
+			digest = digest[:j] // Options are ignored
+		}
+		b, err := base64.StdEncoding.DecodeString(digest)
+		if err != nil {
+			continue
+		}
+		digests[algorithm] = append(digests[algorithm], b)
+	}
+
+	if shasum != "" {
+		if b, err := hex.DecodeString(shasum); err == nil {
+			digests["sha1"] = append(digests["sha1"], b)
+		}
+	}
+
+	for _, a := range integrityAlgorithms {
+		if d, ok := digests[a.name]; ok {
+			return &verifier{Hash: a.new(), algorithm: a.name, digests: d}, nil
+		}
+	}
+	return nil, errors.New("no supported integrity or shasum for package")
+}
+
+// verify returns an error if the written data doesn't match any digest
+func (v *verifier) verify() error {
+	sum := v.Sum(nil)
+	for _, d := range v.digests {
+		if bytes.Equal(sum, d) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s of downloaded file does not match integrity from NPM", v.algorithm)
+}
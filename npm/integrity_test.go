@@ -0,0 +1,56 @@
+package npm
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+)
+
+func TestVerifier(t *testing.T) {
+	data := []byte("package contents")
+	sha1Sum := sha1.Sum(data)
+	sha256Sum := sha256.Sum256(data)
+	sha512Sum := sha512.Sum512(data)
+
+	shasum := hex.EncodeToString(sha1Sum[:])
+	sri256 := "sha256-" + base64.StdEncoding.EncodeToString(sha256Sum[:])
+	sri512 := "sha512-" + base64.StdEncoding.EncodeToString(sha512Sum[:])
+	bad512 := "sha512-" + base64.StdEncoding.EncodeToString(make([]byte, sha512.Size))
+
+	tests := map[string]struct {
+		integrity string
+		shasum    string
+		algorithm string
+		ok        bool
+	}{
+		"shasum only":          {shasum: shasum, algorithm: "sha1", ok: true},
+		"sha512":               {integrity: sri512, shasum: shasum, algorithm: "sha512", ok: true},
+		"strongest wins":       {integrity: sri256 + " " + bad512, shasum: shasum, algorithm: "sha512", ok: false},
+		"any digest matches":   {integrity: bad512 + " " + sri512 + "?opt", algorithm: "sha512", ok: true},
+		"bad shasum":           {shasum: "00", algorithm: "sha1", ok: false},
+		"unsupported fallback": {integrity: "md5-AAAA", shasum: shasum, algorithm: "sha1", ok: true},
+	}
+
+	for label, tt := range tests {
+		t.Run(label, func(t *testing.T) {
+			v, err := newVerifier(tt.integrity, tt.shasum)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.algorithm != tt.algorithm {
+				t.Errorf("algorithm = %s, want %s", v.algorithm, tt.algorithm)
+			}
+			v.Write(data)
+			if err := v.verify(); (err == nil) != tt.ok {
+				t.Errorf("verify() = %v, want ok %t", err, tt.ok)
+			}
+		})
+	}
+
+	if _, err := newVerifier("", ""); err == nil {
+		t.Error("newVerifier() without hashes succeeded")
+	}
+}
@@ -1,15 +1,15 @@
 package npm
 
 import (
-	"crypto/sha1"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
-	"time"
 
 	"github.com/vcabbage/go-unpkg/extract"
 )
@@ -18,78 +18,268 @@ type Package struct {
 	Name    string
 	Version string
 	Hash    string
-	URL     string
-	Main    string
-	Browser string
+	// Integrity is the Subresource Integrity string of the tarball
+	Integrity string
+	URL       string
+	Main      string
+	Browser   Browser
+	Exports   json.RawMessage `json:",omitempty"`
+	// Fields contains every package.json field, including those above
+	Fields map[string]json.RawMessage
 }
 
-// GetMetadata retrieves package metadata from NPM and update Package
-func GetMetadata(name, version string) (*Package, error) {
-	url := "https://registry.npmjs.org/" + name + "/" + version
-	client := &http.Client{Timeout: 10 * time.Second} // TODO: Reuse client
-	resp, err := client.Get(url)
+// Field returns the value of the package.json field name if it is a
+// non-empty string
+func (p *Package) Field(name string) (string, bool) {
+	var s string
+	if err := json.Unmarshal(p.Fields[name], &s); err != nil || s == "" {
+		return "", false
+	}
+	return s, true
+}
+
+// dependencyFields are the package.json fields listing dependencies, in
+// the order they are searched by Dependency
+var dependencyFields = []string{"dependencies", "peerDependencies", "optionalDependencies"}
+
+// Dependency returns the version range of the dependency name
+func (p *Package) Dependency(name string) (string, bool) {
+	for _, field := range dependencyFields {
+		var deps map[string]string
+		if err := json.Unmarshal(p.Fields[field], &deps); err != nil {
+			continue
+		}
+		if rng, ok := deps[name]; ok {
+			return rng, true
+		}
+	}
+	return "", false
+}
+
+var (
+	// ErrNotFound is returned when a package or a version matching the
+	// request does not exist in the registry
+	ErrNotFound = errors.New("package or version not found")
+	// ErrInvalidVersion is returned when a requested version is neither a
+	// dist-tag, version nor valid range
+	ErrInvalidVersion = errors.New("invalid version or range")
+)
+
+// Packument is the full package document listing all published versions
+type Packument struct {
+	Name     string
+	DistTags map[string]string `json:"dist-tags"`
+	// Versions maps each version to its package.json. They are decoded
+	// when resolved as most packages have many versions.
+	Versions map[string]json.RawMessage
+
+	// registry is the base URL the document was retrieved from
+	registry string
+}
+
+// GetPackument retrieves the full package document for name from the
+// registry configured for its scope
+func (c *Client) GetPackument(name string) (*Packument, error) {
+	registry := c.cfg.registryFor(name)
+	url := registry + escapeName(name)
+	resp, err := c.get(c.http, url)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
 	if resp.StatusCode != 200 {
 		return nil, errors.New("bad response: " + resp.Status)
 	}
 
+	d := &Packument{registry: registry}
+	if err := json.NewDecoder(resp.Body).Decode(d); err != nil {
+		return nil, err
+	}
+	if d.Name == "" {
+		d.Name = name
+	}
+
+	return d, nil
+}
+
+// Resolve returns the Package for a dist-tag, exact version or range.
+//
+// Ranges resolve to the highest matching version, unless the version tagged
+// latest satisfies the range, in which case it is preferred as NPM does.
+func (d *Packument) Resolve(spec string) (*Package, error) {
+	if v, ok := d.DistTags[spec]; ok {
+		spec = v
+	}
+
+	if raw, ok := d.Versions[spec]; ok {
+		return newPackage(d.Name, d.registry, raw)
+	}
+
+	r, err := parseRange(spec)
+	if err != nil {
+		return nil, ErrInvalidVersion
+	}
+
+	if latest, ok := d.DistTags["latest"]; ok {
+		if v, err := parseVersion(latest); err == nil && r.match(v) {
+			if raw, ok := d.Versions[latest]; ok {
+				return newPackage(d.Name, d.registry, raw)
+			}
+		}
+	}
+
+	versions := make([]string, 0, len(d.Versions))
+	for v := range d.Versions {
+		versions = append(versions, v)
+	}
+	best, ok := maxSatisfying(versions, r)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return newPackage(d.Name, d.registry, d.Versions[best])
+}
+
+// newPackage creates a Package from a version's package.json retrieved
+// from registry
+func newPackage(name, registry string, raw json.RawMessage) (*Package, error) {
 	var n struct {
 		Version string
 		Main    string
-		Browser string // TODO: Browser could be an object
+		Browser Browser
+		Exports json.RawMessage
 		Dist    struct {
-			SHASum  string
-			TARBall string
+			SHASum    string
+			Integrity string
+			TARBall   string
 		}
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&n); err != nil {
+	if err := json.Unmarshal(raw, &n); err != nil {
 		return nil, err
 	}
 
 	p := &Package{Name: name}
+	if err := json.Unmarshal(raw, &p.Fields); err != nil {
+		return nil, err
+	}
 
 	p.Version = n.Version
 	p.Main = n.Main
 	p.Browser = n.Browser
+	p.Exports = n.Exports
 	p.Hash = n.Dist.SHASum
-	p.URL = strings.Replace(n.Dist.TARBall, "http://", "https://", 1) // Use HTTPS
+	p.Integrity = n.Dist.Integrity
+	p.URL = tarballURL(n.Dist.TARBall, registry)
 
 	return p, nil
 }
 
+// tarballURL returns the URL to download a tarball from.
+//
+// Mirrors commonly serve documents unmodified, so tarballs on the public
+// registry are retrieved from registry instead.
+func tarballURL(u, registry string) string {
+	u = strings.Replace(u, "http://", "https://", 1) // Use HTTPS
+	if registry != "" && strings.HasPrefix(u, DefaultRegistry) {
+		u = registry + strings.TrimPrefix(u, DefaultRegistry)
+	}
+	return u
+}
+
+// escapeName escapes the slash in scoped package names (@scope/name)
+// as required by the registry.
+func escapeName(name string) string {
+	return strings.Replace(name, "/", "%2f", 1)
+}
+
+// tempPrefix prefixes the temporary directories packages are extracted to
+const tempPrefix = ".download-"
+
 // Download downloads and extracts the package from NPM into dest.
 //
-// If the downloaded file does not match the provided hash an error is returned.
-func Download(url, hash, dest string) error {
-	resp, err := http.Get(url)
+// The package is extracted to a temporary directory alongside dest and only
+// moved to dest once verified, so dest is either complete or doesn't exist.
+// If the downloaded file does not match the strongest hash in the package's
+// integrity, or its shasum if it has none, an error is returned.
+func (c *Client) Download(p *Package, dest string) error {
+	return c.download(p, dest, extract.TGZ)
+}
+
+// DownloadArchive downloads the package from NPM into dest like Download,
+// but keeps it as an indexed tarball to be read with extract.OpenArchive
+// rather than extracting it.
+func (c *Client) DownloadArchive(p *Package, dest string) error {
+	return c.download(p, dest, extract.TGZArchive)
+}
+
+// download downloads the package, unpacking it into dest with unpack
+func (c *Client) download(p *Package, dest string, unpack func(io.Reader, string) error) error {
+	v, err := newVerifier(p.Integrity, p.Hash)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.get(c.dl, p.URL)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		fmt.Println("bad response when downloading: ", resp.Status)
+		return errors.New("bad response when downloading: " + resp.Status)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
 		return err
 	}
+	tmp, err := ioutil.TempDir(filepath.Dir(dest), tempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
 
-	hasher := sha1.New()
+	tee := io.TeeReader(resp.Body, v)
+
+	if err := unpack(tee, tmp); err != nil {
+		return fmt.Errorf("extracting tgz: %w", err)
+	}
 
-	tee := io.TeeReader(resp.Body, hasher)
+	// Hash any trailing data not read by the extractor
+	if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+		return err
+	}
+
+	if err := v.verify(); err != nil {
+		return fmt.Errorf("verifying download: %w", err)
+	}
 
-	if err := extract.TGZ(tee, dest); err != nil {
-		fmt.Println("error extracting tgz:", err)
+	// TempDir creates directories only accessible by the owner
+	if err := os.Chmod(tmp, 0755); err != nil {
 		return err
 	}
+	if err := os.Rename(tmp, dest); err != nil {
+		if _, statErr := os.Stat(dest); statErr == nil {
+			return nil // Extracted concurrently by another process
+		}
+		return err
+	}
+	return nil
+}
 
-	if dHash := hex.EncodeToString(hasher.Sum(nil)); dHash != hash {
-		fmt.Println("Hashes differ :(")
-		fmt.Println(dHash)
-		fmt.Println(hash)
-		return errors.New("Hash of downloaded file does not match hash from NPM")
+// RemoveTemp removes temporary directories left in dir by interrupted
+// downloads. It should only be called when no downloads are in progress.
+func RemoveTemp(dir string) error {
+	matches, err := filepath.Glob(filepath.Join(dir, tempPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, m := range matches {
+		if err := os.RemoveAll(m); err != nil {
+			return err
+		}
 	}
 	return nil
 }
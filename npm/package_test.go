@@ -0,0 +1,165 @@
+package npm
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vcabbage/go-unpkg/extract"
+)
+
+var fieldTests = map[string]struct {
+	field string
+	want  string
+	ok    bool
+}{
+	"main":      {field: "main", want: "index.js", ok: true},
+	"custom":    {field: "jsdelivr", want: "dist/cdn.min.js", ok: true},
+	"object":    {field: "browser", ok: false},
+	"empty":     {field: "module", ok: false},
+	"not found": {field: "types", ok: false},
+}
+
+func TestField(t *testing.T) {
+	raw := json.RawMessage(`{
+		"version": "1.0.0",
+		"main": "index.js",
+		"module": "",
+		"jsdelivr": "dist/cdn.min.js",
+		"browser": {"./index.js": "./browser.js"}
+	}`)
+	p, err := newPackage("test", "", raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for label, tt := range fieldTests {
+		t.Run(label, func(t *testing.T) {
+			got, ok := p.Field(tt.field)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("Field(%s) = %q, %t, want %q, %t", tt.field, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestDependency(t *testing.T) {
+	p := &Package{Fields: map[string]json.RawMessage{
+		"dependencies":     json.RawMessage(`{"object-assign": "^4.1.0"}`),
+		"peerDependencies": json.RawMessage(`{"react": ">=15", "object-assign": "*"}`),
+	}}
+
+	for name, want := range map[string]string{"object-assign": "^4.1.0", "react": ">=15"} {
+		if got, ok := p.Dependency(name); !ok || got != want {
+			t.Errorf("Dependency(%s) = %q, %t, want %q", name, got, ok, want)
+		}
+	}
+	if got, ok := p.Dependency("lodash"); ok {
+		t.Errorf("Dependency(lodash) = %q, want not found", got)
+	}
+}
+
+// testTarball returns a tar/gzipped package containing package.json
+func testTarball(t *testing.T) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	body := []byte(`{"name": "test"}`)
+	if err := tw.WriteHeader(&tar.Header{Name: "package/package.json", Mode: 0644, Size: int64(len(body))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDownload(t *testing.T) {
+	tarball := testTarball(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tarball)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := NewClient(Config{})
+	sum := sha512.Sum512(tarball)
+	integrity := "sha512-" + base64.StdEncoding.EncodeToString(sum[:])
+
+	bad := filepath.Join(dir, "bad-1.0.0")
+	if err := c.Download(&Package{URL: srv.URL, Integrity: "sha512-AAAA"}, bad); err == nil {
+		t.Error("Download() with wrong hash succeeded")
+	}
+	if _, err := os.Stat(bad); !os.IsNotExist(err) {
+		t.Error("package directory exists after failed download")
+	}
+
+	good := filepath.Join(dir, "good-1.0.0")
+	if err := c.Download(&Package{URL: srv.URL, Integrity: integrity}, good); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(good, "package.json")); err != nil {
+		t.Error(err)
+	}
+
+	archive := filepath.Join(dir, "archive-1.0.0")
+	if err := c.DownloadArchive(&Package{URL: srv.URL, Integrity: integrity}, archive); err != nil {
+		t.Fatal(err)
+	}
+	if !extract.IsArchive(archive) {
+		t.Error("DownloadArchive() didn't write an archive")
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Errorf("cache directory contains %d entries, want only the packages", len(infos))
+	}
+}
+
+func TestRemoveTemp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{tempPrefix + "123/lib", "react-15.3.1/lib"} {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := RemoveTemp(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, tempPrefix+"123")); !os.IsNotExist(err) {
+		t.Error("temporary directory was not removed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "react-15.3.1")); err != nil {
+		t.Error("package directory was removed")
+	}
+}
@@ -0,0 +1,258 @@
+package npm
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultRegistry is the public NPM registry
+const DefaultRegistry = "https://registry.npmjs.org/"
+
+// Config configures which registries packages are retrieved from
+type Config struct {
+	// Registry is the base URL of the registry used for unscoped packages
+	// and scopes without their own registry. Defaults to DefaultRegistry.
+	Registry string
+	// Scopes maps scopes, including the leading @, to registry base URLs
+	Scopes map[string]string
+	// Auth maps registry URLs without the scheme ("//host/path/"), as used
+	// in .npmrc files, to the credentials sent to them
+	Auth map[string]Credentials
+}
+
+// Credentials authenticate requests to a registry. Token takes precedence
+// over Username and Password.
+type Credentials struct {
+	Token    string
+	Username string
+	Password string
+}
+
+// authFor returns the credentials for the longest registry URL prefixing u
+func (c *Config) authFor(u *url.URL) (Credentials, bool) {
+	target := "//" + u.Host + u.Path
+
+	var (
+		match string
+		cred  Credentials
+	)
+	for prefix, cr := range c.Auth {
+		if len(prefix) > len(match) && strings.HasPrefix(target, prefix) {
+			match, cred = prefix, cr
+		}
+	}
+	return cred, match != ""
+}
+
+// registryFor returns the registry base URL for the package name
+func (c *Config) registryFor(name string) string {
+	if i := strings.IndexByte(name, '/'); strings.HasPrefix(name, "@") && i > 0 {
+		if u, ok := c.Scopes[name[:i]]; ok {
+			return u
+		}
+	}
+	if c.Registry != "" {
+		return c.Registry
+	}
+	return DefaultRegistry
+}
+
+// envRegex matches ${VAR} references in .npmrc values
+var envRegex = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+// ParseNPMRC reads the registry configuration from an .npmrc formatted
+// reader. Environment variables referenced as ${VAR} are expanded.
+//
+// Supported keys are "registry", "@scope:registry" and the per registry
+// "//host/path/:_authToken", ":_auth", ":username" and ":_password";
+// others are ignored.
+func ParseNPMRC(r io.Reader) (*Config, error) {
+	c := &Config{
+		Scopes: make(map[string]string),
+		Auth:   make(map[string]Credentials),
+	}
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			continue
+		}
+		key := strings.TrimSpace(line[:i])
+		value := strings.Trim(strings.TrimSpace(line[i+1:]), `"'`)
+		value = envRegex.ReplaceAllStringFunc(value, func(v string) string {
+			return os.Getenv(v[2 : len(v)-1])
+		})
+
+		switch {
+		case key == "registry":
+			c.Registry = normalizeRegistry(value)
+		case strings.HasPrefix(key, "@") && strings.HasSuffix(key, ":registry"):
+			c.Scopes[strings.TrimSuffix(key, ":registry")] = normalizeRegistry(value)
+		case strings.HasPrefix(key, "//"):
+			if err := c.setAuth(key, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return c, s.Err()
+}
+
+// setAuth applies a "//host/path/:field" .npmrc entry
+func (c *Config) setAuth(key, value string) error {
+	i := strings.LastIndex(key, ":")
+	if i < 0 {
+		return nil
+	}
+	prefix, field := normalizeRegistry(key[:i]), key[i+1:]
+
+	cred := c.Auth[prefix]
+	switch field {
+	case "_authToken":
+		cred.Token = value
+	case "_auth":
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return errors.New("invalid _auth for " + prefix)
+		}
+		userPass := strings.SplitN(string(b), ":", 2)
+		if len(userPass) != 2 {
+			return errors.New("invalid _auth for " + prefix)
+		}
+		cred.Username, cred.Password = userPass[0], userPass[1]
+	case "username":
+		cred.Username = value
+	case "_password":
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return errors.New("invalid _password for " + prefix)
+		}
+		cred.Password = string(b)
+	default:
+		return nil
+	}
+	c.Auth[prefix] = cred
+	return nil
+}
+
+// SetEnvToken configures the NPM_TOKEN environment variable, if set, as the
+// token for the default registry unless it already has credentials.
+func (c *Config) SetEnvToken() {
+	token := os.Getenv("NPM_TOKEN")
+	if token == "" {
+		return
+	}
+
+	prefix := nerfDart(c.registryFor(""))
+	if _, ok := c.Auth[prefix]; ok {
+		return
+	}
+	if c.Auth == nil {
+		c.Auth = make(map[string]Credentials)
+	}
+	c.Auth[prefix] = Credentials{Token: token}
+}
+
+// nerfDart strips the scheme from a registry URL, as used for .npmrc keys
+func nerfDart(registry string) string {
+	if i := strings.Index(registry, "//"); i >= 0 {
+		registry = registry[i:]
+	}
+	return normalizeRegistry(registry)
+}
+
+// LoadNPMRC reads the registry configuration from the .npmrc file at path
+func LoadNPMRC(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseNPMRC(f)
+}
+
+// normalizeRegistry ensures registry base URLs end with a slash
+func normalizeRegistry(u string) string {
+	if u != "" && !strings.HasSuffix(u, "/") {
+		u += "/"
+	}
+	return u
+}
+
+// Client retrieves packages from NPM compatible registries
+type Client struct {
+	cfg Config
+	// http is used for package documents, dl for tarballs which may take
+	// longer than the document timeout
+	http *http.Client
+	dl   *http.Client
+}
+
+// NewClient creates a Client using the registries and credentials in cfg
+func NewClient(cfg Config) *Client {
+	cfg.Registry = normalizeRegistry(cfg.Registry)
+	scopes := make(map[string]string, len(cfg.Scopes))
+	for scope, u := range cfg.Scopes {
+		scopes[scope] = normalizeRegistry(u)
+	}
+	cfg.Scopes = scopes
+	auth := make(map[string]Credentials, len(cfg.Auth))
+	for prefix, cred := range cfg.Auth {
+		auth[normalizeRegistry(prefix)] = cred
+	}
+	cfg.Auth = auth
+
+	c := &Client{cfg: cfg}
+	c.http = &http.Client{Timeout: 30 * time.Second, CheckRedirect: c.checkRedirect}
+	c.dl = &http.Client{CheckRedirect: c.checkRedirect}
+	return c
+}
+
+// get issues a GET request for u with any matching credentials
+func (c *Client) get(client *http.Client, u string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.authorize(req)
+	return client.Do(req)
+}
+
+// authorize sets the Authorization header if credentials are configured
+// for the request URL, removing any existing header otherwise
+func (c *Client) authorize(req *http.Request) {
+	req.Header.Del("Authorization")
+
+	cred, ok := c.cfg.authFor(req.URL)
+	switch {
+	case !ok:
+	case cred.Token != "":
+		req.Header.Set("Authorization", "Bearer "+cred.Token)
+	case cred.Username != "":
+		req.SetBasicAuth(cred.Username, cred.Password)
+	}
+}
+
+// checkRedirect reevaluates credentials for each redirect so they are
+// never sent to a host they weren't configured for
+func (c *Client) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	c.authorize(req)
+	return nil
+}
@@ -0,0 +1,112 @@
+package npm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testNPMRC = `
+; comment
+registry=https://mirror.example.com
+@ourco:registry = "https://npm.${TEST_NPMRC_HOST}/"
+always-auth=true
+`
+
+var registryForTests = map[string]struct {
+	name string
+	want string
+}{
+	"unscoped":     {name: "react", want: "https://mirror.example.com/"},
+	"configured":   {name: "@ourco/widgets", want: "https://npm.ourco.com/"},
+	"unconfigured": {name: "@babel/core", want: "https://mirror.example.com/"},
+	"scope only":   {name: "@ourco", want: "https://mirror.example.com/"},
+	"not a scope":  {name: "ourco/@ourco", want: "https://mirror.example.com/"},
+}
+
+func TestRegistryFor(t *testing.T) {
+	os.Setenv("TEST_NPMRC_HOST", "ourco.com")
+	defer os.Unsetenv("TEST_NPMRC_HOST")
+
+	cfg, err := ParseNPMRC(strings.NewReader(testNPMRC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for label, tt := range registryForTests {
+		t.Run(label, func(t *testing.T) {
+			if got := cfg.registryFor(tt.name); got != tt.want {
+				t.Errorf("registryFor(%s) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTarballURL(t *testing.T) {
+	got := tarballURL("http://registry.npmjs.org/react/-/react-15.3.1.tgz", "https://mirror.example.com/")
+	if want := "https://mirror.example.com/react/-/react-15.3.1.tgz"; got != want {
+		t.Errorf("tarballURL() = %q, want %q", got, want)
+	}
+
+	got = tarballURL("https://npm.ourco.com/@ourco/x/-/x-1.0.0.tgz", "https://npm.ourco.com/")
+	if want := "https://npm.ourco.com/@ourco/x/-/x-1.0.0.tgz"; got != want {
+		t.Errorf("tarballURL() = %q, want %q", got, want)
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	var otherAuth string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		otherAuth = r.Header.Get("Authorization")
+	}))
+	defer other.Close()
+
+	var privateAuth string
+	private := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		privateAuth = r.Header.Get("Authorization")
+		http.Redirect(w, r, other.URL+"/tarball.tgz", http.StatusFound)
+	}))
+	defer private.Close()
+
+	npmrc := nerfDart(private.URL) + ":_authToken=secret\n"
+	cfg, err := ParseNPMRC(strings.NewReader(npmrc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(*cfg)
+
+	resp, err := c.get(c.dl, private.URL+"/@ourco/x/-/x-1.0.0.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if want := "Bearer secret"; privateAuth != want {
+		t.Errorf("registry Authorization = %q, want %q", privateAuth, want)
+	}
+	if otherAuth != "" {
+		t.Errorf("redirect Authorization = %q, want none", otherAuth)
+	}
+}
+
+func TestParseNPMRCBasicAuth(t *testing.T) {
+	npmrc := "//npm.ourco.com/:_auth=dXNlcjpwYXNz\n" +
+		"//npm.ourco.com/other/:username=admin\n" +
+		"//npm.ourco.com/other/:_password=aHVudGVyMg==\n"
+	cfg, err := ParseNPMRC(strings.NewReader(npmrc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]Credentials{
+		"//npm.ourco.com/":       {Username: "user", Password: "pass"},
+		"//npm.ourco.com/other/": {Username: "admin", Password: "hunter2"},
+	}
+	for prefix, cred := range want {
+		if got := cfg.Auth[prefix]; got != cred {
+			t.Errorf("Auth[%s] = %+v, want %+v", prefix, got, cred)
+		}
+	}
+}
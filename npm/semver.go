@@ -0,0 +1,419 @@
+package npm
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// version is a parsed semantic version
+type version struct {
+	major, minor, patch int64
+	pre                 []string // prerelease identifiers
+}
+
+// parseVersion parses a full semantic version, allowing a leading "v" or "="
+// as NPM does. Build metadata is discarded.
+func parseVersion(s string) (version, error) {
+	p, err := parsePartial(s)
+	if err != nil {
+		return version{}, err
+	}
+	if p.minor < 0 || p.patch < 0 {
+		return version{}, fmt.Errorf("incomplete version: %q", s)
+	}
+	return p.version, nil
+}
+
+// partial is a version where major, minor and/or patch may be wildcards,
+// represented by -1
+type partial struct {
+	version
+}
+
+// isWild reports whether the partial matches any version
+func (p partial) isWild() bool { return p.major < 0 }
+
+// parsePartial parses versions such as "1", "1.2", "1.x" or "*"
+func parsePartial(s string) (partial, error) {
+	orig := s
+	s = strings.TrimLeft(strings.TrimSpace(s), "=v")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i] // Build metadata does not affect precedence
+	}
+
+	var p partial
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		p.pre = strings.Split(s[i+1:], ".")
+		for _, id := range p.pre {
+			if id == "" {
+				return partial{}, fmt.Errorf("invalid prerelease: %q", orig)
+			}
+		}
+		s = s[:i]
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return partial{}, fmt.Errorf("invalid version: %q", orig)
+	}
+	nums := [3]int64{-1, -1, -1}
+	for i, part := range parts {
+		if part == "" && len(parts) == 1 {
+			break // Empty string matches any version
+		}
+		if part == "x" || part == "X" || part == "*" {
+			break // Wildcard, remaining parts are also wildcards
+		}
+		n, err := strconv.ParseInt(part, 10, 64)
+		if err != nil || n < 0 || part[0] == '+' {
+			return partial{}, fmt.Errorf("invalid version: %q", orig)
+		}
+		nums[i] = n
+	}
+	p.major, p.minor, p.patch = nums[0], nums[1], nums[2]
+
+	if p.pre != nil && p.patch < 0 {
+		return partial{}, fmt.Errorf("prerelease on incomplete version: %q", orig)
+	}
+	return p, nil
+}
+
+// compareVersions returns -1, 0 or 1 if a is less than, equal to, or greater
+// than b according to semver precedence
+func compareVersions(a, b version) int {
+	switch {
+	case a.major != b.major:
+		return cmpInt(a.major, b.major)
+	case a.minor != b.minor:
+		return cmpInt(a.minor, b.minor)
+	case a.patch != b.patch:
+		return cmpInt(a.patch, b.patch)
+	}
+
+	// A version without prerelease has higher precedence
+	switch {
+	case len(a.pre) == 0 && len(b.pre) == 0:
+		return 0
+	case len(a.pre) == 0:
+		return 1
+	case len(b.pre) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(a.pre) && i < len(b.pre); i++ {
+		if c := comparePrerelease(a.pre[i], b.pre[i]); c != 0 {
+			return c
+		}
+	}
+	return cmpInt(int64(len(a.pre)), int64(len(b.pre)))
+}
+
+// comparePrerelease compares a single pair of prerelease identifiers.
+//
+// Numeric identifiers are compared numerically and have lower precedence
+// than alphanumeric identifiers.
+func comparePrerelease(a, b string) int {
+	an, aErr := strconv.ParseUint(a, 10, 64)
+	bn, bErr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		return cmpInt(int64(an), int64(bn))
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func cmpInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// sameTuple reports whether a and b have the same major, minor and patch
+func sameTuple(a, b version) bool {
+	return a.major == b.major && a.minor == b.minor && a.patch == b.patch
+}
+
+// comparator is a single primitive constraint, such as ">=1.2.3"
+type comparator struct {
+	op string // one of <, <=, >, >=, =
+	v  version
+}
+
+func (c comparator) match(v version) bool {
+	cmp := compareVersions(v, c.v)
+	switch c.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return cmp == 0
+}
+
+// comparatorSet is an intersection of comparators
+type comparatorSet []comparator
+
+// match reports whether v satisfies all comparators in the set.
+//
+// Following NPM, prerelease versions only match if at least one comparator
+// has a prerelease on the same major.minor.patch tuple.
+func (s comparatorSet) match(v version) bool {
+	for _, c := range s {
+		if !c.match(v) {
+			return false
+		}
+	}
+	if len(v.pre) == 0 {
+		return true
+	}
+	for _, c := range s {
+		if len(c.v.pre) > 0 && sameTuple(c.v, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// semverRange is a union of comparator sets
+type semverRange []comparatorSet
+
+func (r semverRange) match(v version) bool {
+	for _, s := range r {
+		if s.match(v) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	// hyphenRegex matches "A - B" ranges
+	hyphenRegex = regexp.MustCompile(`^(\S+)\s+-\s+(\S+)$`)
+	// opSpaceRegex matches whitespace between an operator and version
+	opSpaceRegex = regexp.MustCompile(`(<=|>=|<|>|=|~>|~|\^)\s+`)
+)
+
+// parseRange parses an NPM version range such as "^1.2.0 || >=2.1.0 <3"
+func parseRange(s string) (semverRange, error) {
+	var r semverRange
+	for _, part := range strings.Split(s, "||") {
+		set, err := parseComparatorSet(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, set)
+	}
+	return r, nil
+}
+
+// anyVersion is a comparator matching every non-prerelease version
+var anyVersion = comparator{op: ">=", v: version{}}
+
+// noVersion is a comparator matching nothing
+var noVersion = comparator{op: "<", v: version{pre: []string{"0"}}}
+
+func parseComparatorSet(s string) (comparatorSet, error) {
+	if s == "" {
+		return comparatorSet{anyVersion}, nil
+	}
+
+	if m := hyphenRegex.FindStringSubmatch(s); m != nil {
+		return parseHyphen(m[1], m[2])
+	}
+
+	var set comparatorSet
+	for _, tok := range strings.Fields(opSpaceRegex.ReplaceAllString(s, "$1")) {
+		cs, err := parseComparator(tok)
+		if err != nil {
+			return nil, err
+		}
+		set = append(set, cs...)
+	}
+	return set, nil
+}
+
+// parseHyphen converts the inclusive range "from - to" into comparators
+func parseHyphen(from, to string) (comparatorSet, error) {
+	lo, err := parsePartial(from)
+	if err != nil {
+		return nil, err
+	}
+	hi, err := parsePartial(to)
+	if err != nil {
+		return nil, err
+	}
+
+	set := comparatorSet{anyVersion}
+	if !lo.isWild() {
+		set[0] = comparator{op: ">=", v: lo.floor()}
+	}
+	switch {
+	case hi.isWild():
+	case hi.minor < 0:
+		set = append(set, comparator{op: "<", v: version{major: hi.major + 1, pre: []string{"0"}}})
+	case hi.patch < 0:
+		set = append(set, comparator{op: "<", v: version{major: hi.major, minor: hi.minor + 1, pre: []string{"0"}}})
+	default:
+		set = append(set, comparator{op: "<=", v: hi.version})
+	}
+	return set, nil
+}
+
+// floor returns the lowest version matching the partial
+func (p partial) floor() version {
+	v := p.version
+	if v.major < 0 {
+		v.major = 0
+	}
+	if v.minor < 0 {
+		v.minor = 0
+	}
+	if v.patch < 0 {
+		v.patch = 0
+	}
+	return v
+}
+
+// ceiling returns the exclusive upper bound of the partial, treating the
+// most significant wildcard as the part to increment
+func (p partial) ceiling() version {
+	switch {
+	case p.minor < 0:
+		return version{major: p.major + 1, pre: []string{"0"}}
+	default:
+		return version{major: p.major, minor: p.minor + 1, pre: []string{"0"}}
+	}
+}
+
+// parseComparator converts a single range token into primitive comparators
+func parseComparator(tok string) (comparatorSet, error) {
+	var op string
+	for _, o := range []string{"<=", ">=", "~>", "<", ">", "=", "~", "^"} {
+		if strings.HasPrefix(tok, o) {
+			op = o
+			break
+		}
+	}
+
+	p, err := parsePartial(tok[len(op):])
+	if err != nil {
+		return nil, err
+	}
+	complete := p.patch >= 0
+
+	switch op {
+	case "^":
+		return caret(p), nil
+	case "~", "~>":
+		return tilde(p), nil
+	case "", "=":
+		switch {
+		case p.isWild():
+			return comparatorSet{anyVersion}, nil
+		case complete:
+			return comparatorSet{{op: "=", v: p.version}}, nil
+		}
+		return comparatorSet{{op: ">=", v: p.floor()}, {op: "<", v: p.ceiling()}}, nil
+	case ">":
+		switch {
+		case p.isWild():
+			return comparatorSet{noVersion}, nil
+		case complete:
+			return comparatorSet{{op: ">", v: p.version}}, nil
+		}
+		return comparatorSet{{op: ">=", v: p.ceiling().release()}}, nil
+	case ">=":
+		if p.isWild() {
+			return comparatorSet{anyVersion}, nil
+		}
+		return comparatorSet{{op: ">=", v: p.floor()}}, nil
+	case "<":
+		switch {
+		case p.isWild():
+			return comparatorSet{noVersion}, nil
+		case complete:
+			return comparatorSet{{op: "<", v: p.version}}, nil
+		}
+		v := p.floor()
+		v.pre = []string{"0"}
+		return comparatorSet{{op: "<", v: v}}, nil
+	case "<=":
+		switch {
+		case p.isWild():
+			return comparatorSet{anyVersion}, nil
+		case complete:
+			return comparatorSet{{op: "<=", v: p.version}}, nil
+		}
+		return comparatorSet{{op: "<", v: p.ceiling()}}, nil
+	}
+	return nil, errors.New("unknown operator: " + op)
+}
+
+// release returns v without its prerelease
+func (v version) release() version {
+	v.pre = nil
+	return v
+}
+
+// tilde allows patch-level changes if a minor version is specified, or
+// minor-level changes if not
+func tilde(p partial) comparatorSet {
+	if p.isWild() {
+		return comparatorSet{anyVersion}
+	}
+	return comparatorSet{{op: ">=", v: p.floor()}, {op: "<", v: p.ceiling()}}
+}
+
+// caret allows changes that do not modify the left-most non-zero part
+func caret(p partial) comparatorSet {
+	if p.isWild() {
+		return comparatorSet{anyVersion}
+	}
+
+	var hi version
+	switch {
+	case p.major > 0 || p.minor < 0:
+		hi = version{major: p.major + 1}
+	case p.minor > 0 || p.patch < 0:
+		hi = version{minor: p.minor + 1}
+	default:
+		hi = version{patch: p.patch + 1}
+	}
+	hi.pre = []string{"0"}
+	return comparatorSet{{op: ">=", v: p.floor()}, {op: "<", v: hi}}
+}
+
+// maxSatisfying returns the highest of versions matching r, or false if
+// none match. Invalid versions are ignored.
+func maxSatisfying(versions []string, r semverRange) (string, bool) {
+	var (
+		best   string
+		bestV  version
+		exists bool
+	)
+	for _, s := range versions {
+		v, err := parseVersion(s)
+		if err != nil || !r.match(v) {
+			continue
+		}
+		if !exists || compareVersions(v, bestV) > 0 {
+			best, bestV, exists = s, v, true
+		}
+	}
+	return best, exists
+}
@@ -0,0 +1,132 @@
+package npm
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+var compareTests = map[string]struct {
+	a, b string
+	want int
+}{
+	"equal":                {a: "1.2.3", b: "1.2.3", want: 0},
+	"major":                {a: "2.0.0", b: "1.9.9", want: 1},
+	"minor":                {a: "1.2.0", b: "1.10.0", want: -1},
+	"patch":                {a: "1.2.10", b: "1.2.9", want: 1},
+	"release over pre":     {a: "1.0.0", b: "1.0.0-rc.1", want: 1},
+	"numeric pre":          {a: "1.0.0-alpha.2", b: "1.0.0-alpha.10", want: -1},
+	"numeric before alpha": {a: "1.0.0-1", b: "1.0.0-alpha", want: -1},
+	"longer pre":           {a: "1.0.0-alpha.1", b: "1.0.0-alpha", want: 1},
+	"build ignored":        {a: "1.0.0+build.5", b: "1.0.0", want: 0},
+	"leading v":            {a: "v1.0.0", b: "1.0.0", want: 0},
+	"alpha pre":            {a: "1.0.0-beta", b: "1.0.0-alpha", want: 1},
+}
+
+func TestCompareVersions(t *testing.T) {
+	for label, tt := range compareTests {
+		t.Run(label, func(t *testing.T) {
+			a, err := parseVersion(tt.a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := parseVersion(tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := compareVersions(a, b); got != tt.want {
+				t.Errorf("compareVersions(%s, %s) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+var rangeTests = []struct {
+	rng   string
+	match []string
+	miss  []string
+}{
+	{rng: "", match: []string{"0.0.0", "1.2.3"}, miss: []string{"1.0.0-beta"}},
+	{rng: "*", match: []string{"0.0.1", "99.0.0"}, miss: []string{"1.0.0-rc.1"}},
+	{rng: "1.2.3", match: []string{"1.2.3"}, miss: []string{"1.2.4"}},
+	{rng: "=v1.2.3", match: []string{"1.2.3"}, miss: []string{"1.2.2"}},
+	{rng: "1.x", match: []string{"1.0.0", "1.9.9"}, miss: []string{"2.0.0", "0.9.0"}},
+	{rng: "1.2", match: []string{"1.2.0", "1.2.9"}, miss: []string{"1.3.0"}},
+	{rng: "1.2.*", match: []string{"1.2.5"}, miss: []string{"1.3.0"}},
+	{rng: "^1.2.3", match: []string{"1.2.3", "1.9.0"}, miss: []string{"1.2.2", "2.0.0", "2.0.0-0"}},
+	{rng: "^0.2.3", match: []string{"0.2.3", "0.2.9"}, miss: []string{"0.3.0"}},
+	{rng: "^0.0.3", match: []string{"0.0.3"}, miss: []string{"0.0.4"}},
+	{rng: "^0.0.x", match: []string{"0.0.0", "0.0.9"}, miss: []string{"0.1.0"}},
+	{rng: "^0.x", match: []string{"0.0.1", "0.9.0"}, miss: []string{"1.0.0"}},
+	{rng: "^1.2.3-beta.2", match: []string{"1.2.3-beta.4", "1.2.3"}, miss: []string{"1.2.3-beta.1", "1.2.4-beta.5"}},
+	{rng: "~1.2.3", match: []string{"1.2.3", "1.2.9"}, miss: []string{"1.3.0"}},
+	{rng: "~1.2", match: []string{"1.2.0"}, miss: []string{"1.3.0"}},
+	{rng: "~1", match: []string{"1.0.0", "1.9.0"}, miss: []string{"2.0.0"}},
+	{rng: "~> 1.2", match: []string{"1.2.1"}, miss: []string{"1.3.0"}},
+	{rng: ">= 1.2.3 < 2", match: []string{"1.2.3", "1.99.0"}, miss: []string{"2.0.0", "2.0.0-beta"}},
+	{rng: ">1.2", match: []string{"1.3.0"}, miss: []string{"1.2.9"}},
+	{rng: "<=1.2", match: []string{"1.2.9"}, miss: []string{"1.3.0"}},
+	{rng: "<1.2", match: []string{"1.1.9"}, miss: []string{"1.2.0", "1.2.0-beta"}},
+	{rng: "1.2.3 - 2.3.4", match: []string{"1.2.3", "2.3.4"}, miss: []string{"2.3.5"}},
+	{rng: "1.2 - 2.3", match: []string{"1.2.0", "2.3.9"}, miss: []string{"2.4.0"}},
+	{rng: "1.2.3 - 2", match: []string{"2.9.9"}, miss: []string{"3.0.0"}},
+	{rng: "^1.0.0 || ^3.0.0", match: []string{"1.5.0", "3.1.0"}, miss: []string{"2.0.0"}},
+	{rng: "<1.0.0 || >=2.0.0-rc.1 <2.1", match: []string{"0.5.0", "2.0.0-rc.2"}, miss: []string{"1.0.0"}},
+}
+
+func TestRange(t *testing.T) {
+	for _, tt := range rangeTests {
+		t.Run(tt.rng, func(t *testing.T) {
+			r, err := parseRange(tt.rng)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tt.match {
+				if v, _ := parseVersion(s); !r.match(v) {
+					t.Errorf("%q should match %s", tt.rng, s)
+				}
+			}
+			for _, s := range tt.miss {
+				if v, _ := parseVersion(s); r.match(v) {
+					t.Errorf("%q should not match %s", tt.rng, s)
+				}
+			}
+		})
+	}
+}
+
+var resolveTests = map[string]struct {
+	spec string
+	want string
+	err  error
+}{
+	"tag":              {spec: "next", want: "3.0.0-beta.1"},
+	"exact":            {spec: "1.0.0", want: "1.0.0"},
+	"caret":            {spec: "^1.0.0", want: "1.2.0"},
+	"prefers latest":   {spec: ">=1.0.0", want: "2.0.0"},
+	"prerelease range": {spec: "^3.0.0-beta.0", want: "3.0.0-beta.1"},
+	"no match":         {spec: "^4.0.0", err: ErrNotFound},
+	"invalid":          {spec: "not-a-tag", err: ErrInvalidVersion},
+}
+
+func TestResolve(t *testing.T) {
+	d := &Packument{
+		Name:     "test",
+		DistTags: map[string]string{"latest": "2.0.0", "next": "3.0.0-beta.1"},
+		Versions: make(map[string]json.RawMessage),
+	}
+	for _, v := range []string{"1.0.0", "1.2.0", "2.0.0", "2.1.0", "3.0.0-beta.1"} {
+		d.Versions[v] = json.RawMessage(`{"version":"` + v + `"}`)
+	}
+
+	for label, tt := range resolveTests {
+		t.Run(label, func(t *testing.T) {
+			p, err := d.Resolve(tt.spec)
+			if err != tt.err {
+				t.Fatalf("Resolve(%s) error = %v, want %v", tt.spec, err, tt.err)
+			}
+			if err == nil && p.Version != tt.want {
+				t.Errorf("Resolve(%s) = %s, want %s", tt.spec, p.Version, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// blobsDirName is the directory within the cache directory holding the
+// content of extracted package files, stored once per distinct content.
+// Like generatedDirName, it has no "-" so no package directory shares it.
+const blobsDirName = "_blobs"
+
+// blobRef is a package file hardlinked to a blob
+type blobRef struct {
+	name string // file name of the blob
+	path string // of the package file
+	size int64
+}
+
+// dedupe replaces each file in pkgDir with a hardlink to the blob of the
+// same content in blobsDir, adding a blob for content not stored yet.
+// Consecutive versions of a package share most files, so this stores each
+// of them once.
+//
+// Returns the files linked, which are all of them unless an error is
+// returned. Files not linked are left as they are.
+func dedupe(pkgDir, blobsDir string) ([]blobRef, error) {
+	var refs []blobRef
+	err := filepath.Walk(pkgDir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+
+		name, err := blobName(p, fi)
+		if err != nil {
+			return err
+		}
+		if err := linkBlob(p, filepath.Join(blobsDir, name[:2], name)); err != nil {
+			return err
+		}
+		refs = append(refs, blobRef{name: name, path: p, size: fi.Size()})
+		return nil
+	})
+	return refs, err
+}
+
+// blobName returns the name of the blob for the file at p: the SHA-256 of
+// its content and its permissions, which linked files share
+func blobName(p string, fi os.FileInfo) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x-%o", h.Sum(nil), fi.Mode().Perm()), nil
+}
+
+// linkBlob adds the file at p as blob, or if blob already exists, replaces
+// p with a hardlink to it
+func linkBlob(p, blob string) error {
+	if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+		return err
+	}
+	for {
+		if err := os.Link(p, blob); !os.IsExist(err) {
+			return err
+		}
+		if err := replaceWithLink(p, blob); !os.IsNotExist(err) {
+			return err
+		}
+		// The blob was evicted since, add p instead
+	}
+}
+
+// relinkBlob links the package file of ref to its blob in blobsDir again if
+// the blob was removed or replaced since dedupe linked them
+func relinkBlob(ref blobRef, blobsDir string) error {
+	fi, err := os.Stat(ref.path)
+	if err != nil {
+		return err
+	}
+	blob := filepath.Join(blobsDir, ref.name[:2], ref.name)
+	if bi, err := os.Stat(blob); err == nil && os.SameFile(fi, bi) {
+		return nil
+	}
+	return linkBlob(ref.path, blob)
+}
+
+// replaceWithLink replaces the file at p with a hardlink to target. The
+// link is made at a temporary name and renamed over p, so that p is never
+// missing.
+func replaceWithLink(p, target string) error {
+	if fi, err := os.Stat(p); err == nil {
+		// Renaming a link over the same file does nothing, leaving it behind
+		if ti, err := os.Stat(target); err == nil && os.SameFile(fi, ti) {
+			return nil
+		}
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(target), ".link")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	os.Remove(tmp.Name())
+
+	if err := os.Link(target, tmp.Name()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// removeBlobTemp removes temporary links left in the blobs directory of
+// cacheDir by interrupted calls to linkBlob. It should only be called when
+// none are in progress.
+func removeBlobTemp(cacheDir string) error {
+	matches, err := filepath.Glob(filepath.Join(cacheDir, blobsDirName, "*", ".link*"))
+	if err != nil {
+		return err
+	}
+	for _, m := range matches {
+		if err := os.Remove(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refsSize returns the total size of the files in refs
+func refsSize(refs []blobRef) int64 {
+	var size int64
+	for _, ref := range refs {
+		size += ref.size
+	}
+	return size
+}
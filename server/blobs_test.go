@@ -0,0 +1,122 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFiles creates files in dir from a map of paths to content
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func sameFile(t *testing.T, a, b string) bool {
+	fa, err := os.Stat(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return os.SameFile(fa, fb)
+}
+
+func TestDedupe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blobsDir := filepath.Join(dir, blobsDirName)
+
+	v1 := filepath.Join(dir, "pkg-1.0.0")
+	v2 := filepath.Join(dir, "pkg-2.0.0")
+	writeFiles(t, v1, map[string]string{"lib/index.js": "shared", "CHANGELOG.md": "1.0.0"})
+	writeFiles(t, v2, map[string]string{"lib/index.js": "shared", "CHANGELOG.md": "2.0.0", "copy.js": "shared"})
+	// Already the blob once CHANGELOG.md is added as one
+	if err := os.Link(filepath.Join(v1, "CHANGELOG.md"), filepath.Join(v1, "hard.md")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("lib/index.js", filepath.Join(v2, "main.js")); err != nil {
+		t.Fatal(err)
+	}
+
+	refs1, err := dedupe(v1, blobsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs2, err := dedupe(v2, blobsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs1) != 3 || len(refs2) != 3 {
+		t.Errorf("linked %d and %d files, want 3 and 3", len(refs1), len(refs2))
+	}
+	if got, want := refsSize(refs2), int64(len("shared")*2+len("2.0.0")); got != want {
+		t.Errorf("refsSize() = %d, want %d", got, want)
+	}
+
+	if !sameFile(t, filepath.Join(v1, "lib", "index.js"), filepath.Join(v2, "lib", "index.js")) ||
+		!sameFile(t, filepath.Join(v1, "lib", "index.js"), filepath.Join(v2, "copy.js")) {
+		t.Error("files with the same content aren't linked")
+	}
+	if sameFile(t, filepath.Join(v1, "CHANGELOG.md"), filepath.Join(v2, "CHANGELOG.md")) {
+		t.Error("files with different content are linked")
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(v2, "main.js")); string(b) != "shared" || err != nil {
+		t.Errorf("main.js = %q, %v, want shared", b, err)
+	}
+
+	blobs, err := readBlobs(blobsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, candidates := range blobs {
+		n += len(candidates)
+	}
+	if n != 3 {
+		t.Errorf("stored %d blobs, want 3", n)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(blobsDir, "*", ".link*")); len(matches) != 0 {
+		t.Errorf("temporary links left: %q", matches)
+	}
+}
+
+func TestRemoveBlobTemp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, filepath.Join(dir, blobsDirName), map[string]string{
+		"ab/abcd-644":     "blob",
+		"ab/.link1234567": "blob",
+	})
+	if err := removeBlobTemp(dir); err != nil {
+		t.Fatal(err)
+	}
+	if exists(filepath.Join(dir, blobsDirName, "ab", ".link1234567")) {
+		t.Error("temporary link not removed")
+	}
+	if !exists(filepath.Join(dir, blobsDirName, "ab", "abcd-644")) {
+		t.Error("blob removed")
+	}
+
+	// The cache directory may not exist yet
+	if err := removeBlobTemp(filepath.Join(dir, "missing")); err != nil {
+		t.Errorf("removeBlobTemp() of missing directory error = %v", err)
+	}
+}
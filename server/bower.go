@@ -0,0 +1,171 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/vcabbage/go-unpkg/npm"
+)
+
+// bowerModTime is used for all zip entries so that bundles are identical
+// regardless of when they were built. It matches the time used by NPM for
+// tarball entries.
+var bowerModTime = time.Date(1985, time.October, 26, 8, 15, 0, 0, time.UTC)
+
+// serveBower sends a Bower bundle of pkg, building it on first request
+func (h *handler) serveBower(w http.ResponseWriter, r *http.Request, pkg *npm.Package) {
+	pkgDir := filepath.Join(h.cacheDir, pkgDirName(pkg.Name, pkg.Version))
+
+	release := h.disk.acquire(pkgDirName(pkg.Name, pkg.Version))
+	defer release()
+
+	if !h.isDownloaded(pkg, pkgDir) {
+		if err := h.download(pkg, pkgDir); err != nil {
+			log.Printf("Error downloading %q: %v\n", pkg.URL, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	fsys, closeFS, err := h.packageFS(pkgDir)
+	if err != nil {
+		log.Printf("Error opening %q: %v\n", pkgDir, err)
+		http.Error(w, "error opening package", http.StatusInternalServerError)
+		return
+	}
+	defer closeFS()
+
+	zipPath := filepath.Join(h.generatedDir(pkg), "bower.zip")
+	if _, err := os.Stat(zipPath); os.IsNotExist(err) {
+		// Use singleflight to supress building the same bundle concurrently
+		_, err, _ = h.sf.Do(zipPath, func() (interface{}, error) {
+			if err := buildBower(pkg, fsys, zipPath); err != nil {
+				return nil, err
+			}
+			h.generated(pkg, zipPath)
+			return nil, nil
+		})
+		if err != nil {
+			log.Printf("Error building bower bundle for %q %s: %v\n", pkg.Name, pkg.Version, err)
+			http.Error(w, "error building bower bundle", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Bundles are built deterministically, so the package hash identifies them
+	w.Header().Set("ETag", `"bower-`+pkg.Hash+`"`)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Cache-Control", immutable)
+	http.ServeFile(w, r, zipPath)
+}
+
+// buildBower writes a zip of the package files fsys to dest, adding a
+// bower.json generated from package.json unless the package includes one
+func buildBower(pkg *npm.Package, fsys fs.FS, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file so partial bundles are never served
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), "bower")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	zw := zip.NewWriter(tmp)
+	hasBowerJSON := false
+	err = fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		if p == "bower.json" {
+			hasBowerJSON = true
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		f, err := fsys.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return addZipFile(zw, p, fi.Mode(), f)
+	})
+	if err != nil {
+		return err
+	}
+
+	if !hasBowerJSON {
+		b, err := json.MarshalIndent(bowerJSON(pkg), "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := addZipFile(zw, "bower.json", 0644, bytes.NewReader(b)); err != nil {
+			return err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+// addZipFile adds the contents of r to zw as name
+func addZipFile(zw *zip.Writer, name string, mode os.FileMode, r io.Reader) error {
+	hdr := &zip.FileHeader{Name: name, Method: zip.Deflate}
+	hdr.Modified = bowerModTime
+	hdr.SetMode(mode)
+
+	fw, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, r)
+	return err
+}
+
+// bowerFields are the package.json fields copied to bower.json as is
+var bowerFields = []string{"description", "license", "keywords", "homepage"}
+
+// bowerJSON generates a bower.json from the package.json fields of pkg
+func bowerJSON(pkg *npm.Package) map[string]interface{} {
+	b := map[string]interface{}{
+		"name": pkg.Name,
+	}
+
+	switch {
+	case pkg.Browser.Main != "":
+		b["main"] = pkg.Browser.Main
+	case pkg.Main != "":
+		b["main"] = pkg.Main
+	}
+
+	for _, field := range bowerFields {
+		if v, ok := pkg.Fields[field]; ok {
+			b[field] = v
+		}
+	}
+	if v, ok := pkg.Fields["author"]; ok {
+		b["authors"] = []json.RawMessage{v}
+	}
+
+	return b
+}
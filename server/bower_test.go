@@ -0,0 +1,82 @@
+package server
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/vcabbage/go-unpkg/npm"
+)
+
+func TestBuildBower(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bower")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pkgDir := filepath.Join(dir, "pkg")
+	if err := os.MkdirAll(filepath.Join(pkgDir, "dist"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(pkgDir, "dist", "pkg.js"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pkg := &npm.Package{
+		Name:    "pkg",
+		Version: "1.0.0",
+		Main:    "dist/pkg.js",
+		Fields: map[string]json.RawMessage{
+			"description": json.RawMessage(`"A package"`),
+			"author":      json.RawMessage(`"Someone"`),
+			"scripts":     json.RawMessage(`{}`),
+		},
+	}
+
+	dest := filepath.Join(dir, "generated", "bower.zip")
+	if err := buildBower(pkg, os.DirFS(pkgDir), dest); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.OpenReader(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	var names []string
+	var bower map[string]interface{}
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		if f.Name != "bower.json" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = json.NewDecoder(rc).Decode(&bower)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want := []string{"dist/pkg.js", "bower.json"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("zip entries = %v, want %v", names, want)
+	}
+	want := map[string]interface{}{
+		"name":        "pkg",
+		"main":        "dist/pkg.js",
+		"description": "A package",
+		"authors":     []interface{}{"Someone"},
+	}
+	if !reflect.DeepEqual(bower, want) {
+		t.Errorf("bower.json = %v, want %v", bower, want)
+	}
+}
@@ -2,11 +2,13 @@ package server
 
 import (
 	"errors"
+	"log"
 	"sync"
 
 	"time"
 
 	"github.com/vcabbage/go-unpkg/npm"
+	"golang.org/x/sync/singleflight"
 )
 
 // cache handles retrieving package metadata from NPM
@@ -15,6 +17,8 @@ type cache struct {
 	// these should not change and are not timed out
 	resolvedMu   sync.RWMutex
 	resolvedPkgs map[string]npm.Package
+	// persists resolved packages across restarts, may be nil
+	store *packageStore
 
 	// caches the resolved Package for the unresolved version
 	// theses are timed out
@@ -22,8 +26,18 @@ type cache struct {
 	unresolvedPkgs    map[string]npm.Package
 	unresolvedTimeIdx []timeIdx
 
+	// caches the full package documents used to resolve versions
+	// these are timed out
+	packumentMu      sync.RWMutex
+	packuments       map[string]*npm.Packument
+	packumentTimeIdx []timeIdx
+	packumentSF      singleflight.Group
+
 	// used by the cache cleaner
 	timeout time.Duration
+
+	// used to retrieve package documents
+	registry *npm.Client
 }
 
 // timeIdx correlates a index with the time it was added
@@ -32,14 +46,25 @@ type timeIdx struct {
 	i        string
 }
 
-// newCache creates a new cache and starts the cache cleaner goroutine
-func newCache(timeout time.Duration) *cache {
+// newCache creates a new cache, loading the resolved packages in store if
+// not nil, and starts the cache cleaner goroutine
+func newCache(timeout time.Duration, registry *npm.Client, store *packageStore) *cache {
 	c := &cache{
+		registry:       registry,
 		resolvedPkgs:   make(map[string]npm.Package),
+		store:          store,
 		unresolvedPkgs: make(map[string]npm.Package),
+		packuments:     make(map[string]*npm.Packument),
 		timeout:        timeout,
 	}
 
+	if store != nil {
+		for _, p := range store.packages {
+			c.resolvedPkgs[cacheKey(p.Name, p.Version)] = p
+		}
+		store.packages = nil
+	}
+
 	c.startCleaner()
 
 	return c
@@ -47,7 +72,7 @@ func newCache(timeout time.Duration) *cache {
 
 // getPackage tries retrieving packages from cache, failing that it will resolve the package
 func (c *cache) getPackage(name, version string) (*npm.Package, error) {
-	key := name + version
+	key := cacheKey(name, version)
 	c.resolvedMu.RLock()
 	cached, ok := c.resolvedPkgs[key]
 	c.resolvedMu.RUnlock()
@@ -65,22 +90,91 @@ func (c *cache) getPackage(name, version string) (*npm.Package, error) {
 	return nil, errors.New("not found")
 }
 
+// lookupPackage returns the package for name and version from the cache,
+// resolving it if it isn't cached
+func (c *cache) lookupPackage(name, version string) (*npm.Package, error) {
+	if p, err := c.getPackage(name, version); err == nil {
+		return p, nil
+	}
+	return c.resolvePackage(name, version)
+}
+
+// resolvePackage resolves version against the package document for name,
+// fetching the document from NPM if it isn't cached. The result is added
+// to the cache.
+func (c *cache) resolvePackage(name, version string) (*npm.Package, error) {
+	doc, err := c.getPackument(name)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := doc.Resolve(version)
+	if err != nil {
+		return nil, err
+	}
+
+	c.addPackage(p, version)
+	return p, nil
+}
+
+// getPackument returns the package document for name from cache or NPM
+func (c *cache) getPackument(name string) (*npm.Packument, error) {
+	c.packumentMu.RLock()
+	doc, ok := c.packuments[name]
+	c.packumentMu.RUnlock()
+	if ok {
+		return doc, nil
+	}
+
+	// Use singleflight to supress fetching the same document concurrently
+	v, err, _ := c.packumentSF.Do(name, func() (interface{}, error) {
+		doc, err := c.registry.GetPackument(name)
+		if err != nil {
+			return nil, err
+		}
+
+		c.packumentMu.Lock()
+		c.packuments[name] = doc
+		c.packumentTimeIdx = append(c.packumentTimeIdx, timeIdx{time.Now().Unix(), name})
+		c.packumentMu.Unlock()
+
+		return doc, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*npm.Packument), nil
+}
+
 // addPackage adds a resolved package to the cache. If any unresolvedVersions
 // are specified, they will be added to the unresolvedCache.
 func (c *cache) addPackage(p *npm.Package, unresolvedVersions ...string) {
+	key := cacheKey(p.Name, p.Version)
 	c.resolvedMu.Lock()
-	c.resolvedPkgs[p.Name+p.Version] = *p
+	_, exists := c.resolvedPkgs[key]
+	c.resolvedPkgs[key] = *p
 	c.resolvedMu.Unlock()
 
+	if !exists && c.store != nil {
+		if err := c.store.add(p); err != nil {
+			log.Printf("Error persisting %q %s: %v\n", p.Name, p.Version, err)
+		}
+	}
+
 	c.unresolvedMu.Lock()
 	for _, version := range unresolvedVersions {
-		i := p.Name + version
+		i := cacheKey(p.Name, version)
 		c.unresolvedPkgs[i] = *p
 		c.unresolvedTimeIdx = append(c.unresolvedTimeIdx, timeIdx{time.Now().Unix(), i})
 	}
 	c.unresolvedMu.Unlock()
 }
 
+// cacheKey returns the key used to store a name/version pair
+func cacheKey(name, version string) string {
+	return name + "@" + version
+}
+
 // startCleaners starts the cleaner goroutine and returns
 func (c *cache) startCleaner() {
 	if c.timeout <= 0 {
@@ -95,20 +189,32 @@ func (c *cache) startCleaner() {
 	}()
 }
 
-// clean removes all entries from unresolvedCache that are older
-// than timeout
+// clean removes all entries from unresolvedCache and the package
+// document cache that are older than timeout
 func (c *cache) clean() {
 	keep := time.Now().Unix() - int64(c.timeout.Seconds())
 
-	var lastIdx int
 	c.unresolvedMu.Lock()
-	for i, timeI := range c.unresolvedTimeIdx {
+	c.unresolvedTimeIdx = expire(c.unresolvedTimeIdx, keep, func(i string) {
+		delete(c.unresolvedPkgs, i)
+	})
+	c.unresolvedMu.Unlock()
+
+	c.packumentMu.Lock()
+	c.packumentTimeIdx = expire(c.packumentTimeIdx, keep, func(i string) {
+		delete(c.packuments, i)
+	})
+	c.packumentMu.Unlock()
+}
+
+// expire calls remove for each entry in idx added at or before keep and
+// returns the remaining entries
+func expire(idx []timeIdx, keep int64, remove func(string)) []timeIdx {
+	for n, timeI := range idx {
 		if timeI.unixTime > keep {
-			lastIdx = i
-			break
+			return idx[n:]
 		}
-		delete(c.unresolvedPkgs, timeI.i)
+		remove(timeI.i)
 	}
-	c.unresolvedTimeIdx = c.unresolvedTimeIdx[lastIdx:]
-	c.unresolvedMu.Unlock()
+	return idx[:0]
 }
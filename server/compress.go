@@ -0,0 +1,197 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/vcabbage/go-unpkg/npm"
+)
+
+// encoding is a content coding files can be stored and sent in
+type encoding struct {
+	name     string // Content-Encoding token
+	ext      string // extension of stored variants
+	compress func(w io.Writer, src []byte) error
+}
+
+// encodings are the supported content codings, in order of preference
+// when the client accepts several with the same quality
+var encodings = []encoding{
+	{name: "br", ext: ".br", compress: compressBrotli},
+	{name: "gzip", ext: ".gz", compress: compressGzip},
+}
+
+// compressedDirName is the directory within a package's generated directory
+// holding compressed variants of its files
+const compressedDirName = "compressed"
+
+// minCompressSize is the size below which files aren't compressed, as the
+// savings don't outweigh the overhead
+const minCompressSize = 256
+
+// serveContent sends the file at p within fsys, of pkg. name is the path
+// used to determine the content type when the Content-Type header isn't set.
+//
+// If the file is compressible and the client accepts one of encodings, the
+// variant stored at variant plus the encoding's extension is sent instead,
+// creating it on first request. Range and conditional requests apply to the
+// sent variant.
+func (h *handler) serveContent(w http.ResponseWriter, r *http.Request, pkg *npm.Package, name string, fsys fs.FS, p, variant string) {
+	ct := w.Header().Get("Content-Type")
+	if ct == "" {
+		ct = contentType(name)
+	}
+
+	src, err := fs.Stat(fsys, p)
+	if err != nil || !src.Mode().IsRegular() || src.Size() < minCompressSize || !compressible(ct) {
+		http.ServeFileFS(w, r, fsys, p)
+		return
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	enc, ok := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	if !ok {
+		http.ServeFileFS(w, r, fsys, p)
+		return
+	}
+
+	variant += enc.ext
+	if _, err := os.Stat(variant); os.IsNotExist(err) {
+		// Use singleflight to supress compressing the same file concurrently
+		_, err, _ = h.sf.Do(variant, func() (interface{}, error) {
+			if err := buildVariant(enc, fsys, p, variant); err != nil {
+				return nil, err
+			}
+			h.generated(pkg, variant)
+			return nil, nil
+		})
+		if err != nil {
+			log.Printf("Error compressing %q: %v\n", p, err)
+			http.ServeFileFS(w, r, fsys, p) // Send uncompressed instead
+			return
+		}
+	}
+
+	f, err := os.Open(variant)
+	if err != nil {
+		log.Printf("Error opening %q: %v\n", variant, err)
+		http.ServeFileFS(w, r, fsys, p)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Content-Encoding", enc.name)
+	if etag := w.Header().Get("ETag"); strings.HasSuffix(etag, `"`) {
+		// Each encoding is a different representation, requiring its own tag
+		w.Header().Set("ETag", etag[:len(etag)-1]+"-"+enc.name+`"`)
+	}
+	http.ServeContent(w, r, name, src.ModTime(), f)
+}
+
+// buildVariant compresses the file at p within fsys with enc and writes it
+// to dest
+func buildVariant(enc encoding, fsys fs.FS, p, dest string) error {
+	src, err := fs.ReadFile(fsys, p)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := enc.compress(&buf, src); err != nil {
+		return err
+	}
+	return writeFileAtomic(dest, buf.Bytes())
+}
+
+// compressBrotli uses the best compression, as variants are only built
+// once per file
+func compressBrotli(w io.Writer, src []byte) error {
+	bw := brotli.NewWriterLevel(w, brotli.BestCompression)
+	if _, err := bw.Write(src); err != nil {
+		return err
+	}
+	return bw.Close()
+}
+
+func compressGzip(w io.Writer, src []byte) error {
+	gw, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	if _, err := gw.Write(src); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// compressible reports whether content of type ct benefits from compression
+func compressible(ct string) bool {
+	if i := strings.IndexByte(ct, ';'); i >= 0 {
+		ct = ct[:i] // Strip parameters
+	}
+	ct = strings.ToLower(strings.TrimSpace(ct))
+
+	switch {
+	case strings.HasPrefix(ct, "text/"),
+		strings.HasSuffix(ct, "+json"),
+		strings.HasSuffix(ct, "+xml"):
+		return true
+	}
+	switch ct {
+	case "application/javascript",
+		"application/json",
+		"application/xml",
+		"application/wasm":
+		return true
+	}
+	return false
+}
+
+// negotiateEncoding returns the encoding with the highest quality in the
+// Accept-Encoding header, or false if none are acceptable
+func negotiateEncoding(accept string) (encoding, bool) {
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		qualities[coding] = q
+	}
+
+	var (
+		best  encoding
+		bestQ float64
+		found bool
+	)
+	for _, enc := range encodings {
+		q, ok := qualities[enc.name]
+		if !ok {
+			q = qualities["*"]
+		}
+		if q > bestQ {
+			best, bestQ, found = enc, q, true
+		}
+	}
+	return best, found
+}
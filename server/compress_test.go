@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/vcabbage/go-unpkg/npm"
+)
+
+var negotiateEncodingTests = map[string]struct {
+	accept string
+	want   string
+}{
+	"empty":         {accept: "", want: ""},
+	"gzip":          {accept: "gzip, deflate", want: "gzip"},
+	"case":          {accept: "GZIP", want: "gzip"},
+	"br":            {accept: "br", want: "br"},
+	"both":          {accept: "gzip, deflate, br", want: "br"},
+	"quality":       {accept: "br;q=1.0, gzip;q=0.8", want: "br"},
+	"quality,gzip":  {accept: "br;q=0.5, gzip;q=0.8", want: "gzip"},
+	"refused":       {accept: "gzip;q=0, deflate", want: ""},
+	"refused,br":    {accept: "br;q=0, gzip", want: "gzip"},
+	"wildcard":      {accept: "*", want: "br"},
+	"wildcard,gzip": {accept: "gzip;q=1, *;q=0.1", want: "gzip"},
+	"wildcard,zero": {accept: "*;q=0", want: ""},
+	"identity":      {accept: "identity", want: ""},
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	for label, tt := range negotiateEncodingTests {
+		t.Run(label, func(t *testing.T) {
+			enc, _ := negotiateEncoding(tt.accept)
+			if enc.name != tt.want {
+				t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.accept, enc.name, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeContent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := strings.Repeat("console.log('compressible');\n", 100)
+	src := filepath.Join(dir, "index.js")
+	if err := ioutil.WriteFile(src, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	variant := filepath.Join(dir, "compressed", "index.js")
+
+	h := &handler{}
+	pkg := &npm.Package{Name: "test", Version: "1.0.0"}
+	serve := func(header http.Header) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header = header
+		w.Header().Set("ETag", `"tag"`)
+		h.serveContent(w, r, pkg, "/index.js", os.DirFS(dir), "index.js", variant)
+		return w
+	}
+
+	// Identity
+	w := serve(http.Header{})
+	if w.Code != http.StatusOK || w.Body.String() != content {
+		t.Errorf("identity response = %d %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", got)
+	}
+	if got := w.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("identity Content-Encoding = %q", got)
+	}
+
+	// Gzip
+	w = serve(http.Header{"Accept-Encoding": {"gzip"}})
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	if got := w.Header().Get("Content-Type"); !strings.Contains(got, "javascript") {
+		t.Errorf("Content-Type = %q, want javascript", got)
+	}
+	etag := w.Header().Get("ETag")
+	if etag != `"tag-gzip"` {
+		t.Errorf("ETag = %q, want %q", etag, `"tag-gzip"`)
+	}
+	compressed := w.Body.Bytes()
+	gr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(gr); err != nil || string(b) != content {
+		t.Errorf("decompressed body = %q, %v", b, err)
+	}
+	if _, err := os.Stat(variant + ".gz"); err != nil {
+		t.Errorf("variant not stored: %v", err)
+	}
+
+	// Brotli
+	w = serve(http.Header{"Accept-Encoding": {"gzip, br"}})
+	if got := w.Header().Get("Content-Encoding"); got != "br" {
+		t.Fatalf("Content-Encoding = %q, want br", got)
+	}
+	if got := w.Header().Get("ETag"); got != `"tag-br"` {
+		t.Errorf("ETag = %q, want %q", got, `"tag-br"`)
+	}
+	if b, err := ioutil.ReadAll(brotli.NewReader(w.Body)); err != nil || string(b) != content {
+		t.Errorf("decompressed body = %q, %v", b, err)
+	}
+	if _, err := os.Stat(variant + ".br"); err != nil {
+		t.Errorf("variant not stored: %v", err)
+	}
+
+	// Range of the compressed variant
+	w = serve(http.Header{"Accept-Encoding": {"gzip"}, "Range": {"bytes=0-9"}})
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), compressed[:10]) {
+		t.Errorf("range response = %d %x, want %d %x", w.Code, w.Body.Bytes(), http.StatusPartialContent, compressed[:10])
+	}
+
+	// Conditional
+	w = serve(http.Header{"Accept-Encoding": {"gzip"}, "If-None-Match": {etag}})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("conditional response = %d, want %d", w.Code, http.StatusNotModified)
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsMethods are the methods allowed in cross-origin requests
+const corsMethods = "GET, HEAD, OPTIONS"
+
+// corsExposedHeaders are the response headers readable by cross-origin
+// scripts, in addition to those browsers always expose
+const corsExposedHeaders = "ETag, Integrity, Content-Encoding, Content-Range"
+
+// corsMaxAge is how long browsers may cache preflight responses, in seconds
+const corsMaxAge = "86400"
+
+// cors is middleware adding Cross-Origin Resource Sharing headers to
+// responses of next, and responding to preflight requests
+type cors struct {
+	next    http.Handler
+	any     bool // all origins are allowed
+	origins map[string]bool
+}
+
+// newCORS wraps next to allow cross-origin requests from origins.
+// "*" allows any origin.
+func newCORS(next http.Handler, origins []string) *cors {
+	c := &cors{next: next, origins: make(map[string]bool)}
+	for _, o := range origins {
+		o = strings.TrimSpace(o)
+		switch o {
+		case "":
+		case "*":
+			c.any = true
+		default:
+			c.origins[strings.TrimSuffix(o, "/")] = true
+		}
+	}
+	return c
+}
+
+func (c *cors) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	allowed := origin != "" && (c.any || c.origins[origin])
+
+	if !c.any {
+		// The response depends on the origin when it's echoed
+		w.Header().Add("Vary", "Origin")
+	}
+	if allowed {
+		if c.any {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+	}
+
+	if r.Method != http.MethodOptions {
+		if allowed {
+			w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		}
+		c.next.ServeHTTP(w, r)
+		return
+	}
+
+	if r.Header.Get("Access-Control-Request-Method") == "" {
+		// Not a preflight, there's nothing more to the resource than GET
+		w.Header().Set("Allow", corsMethods)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if !allowed {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+	w.Header().Set("Access-Control-Allow-Methods", corsMethods)
+	if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+		// Requests can't modify anything, so any header is fine
+		w.Header().Set("Access-Control-Allow-Headers", headers)
+	}
+	w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+	w.WriteHeader(http.StatusNoContent)
+}
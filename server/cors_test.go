@@ -0,0 +1,130 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var corsTests = map[string]struct {
+	origins []string
+	method  string
+	header  http.Header
+
+	status int
+	want   map[string]string // expected response headers, "" for absent
+}{
+	"any": {
+		origins: []string{"*"},
+		method:  "GET",
+		header:  http.Header{"Origin": {"https://app.example.com"}},
+		status:  http.StatusOK,
+		want: map[string]string{
+			"Access-Control-Allow-Origin":   "*",
+			"Access-Control-Expose-Headers": corsExposedHeaders,
+			"Vary":                          "",
+		},
+	},
+	"listed": {
+		origins: []string{"https://app.example.com/", "https://other.example.com"},
+		method:  "GET",
+		header:  http.Header{"Origin": {"https://app.example.com"}},
+		status:  http.StatusOK,
+		want: map[string]string{
+			"Access-Control-Allow-Origin": "https://app.example.com",
+			"Vary":                        "Origin",
+		},
+	},
+	"not listed": {
+		origins: []string{"https://app.example.com"},
+		method:  "GET",
+		header:  http.Header{"Origin": {"https://evil.example.com"}},
+		status:  http.StatusOK,
+		want: map[string]string{
+			"Access-Control-Allow-Origin":   "",
+			"Access-Control-Expose-Headers": "",
+			"Vary":                          "Origin",
+		},
+	},
+	"same origin": {
+		origins: []string{"*"},
+		method:  "GET",
+		status:  http.StatusOK,
+		want: map[string]string{
+			"Access-Control-Allow-Origin": "",
+		},
+	},
+	"disabled": {
+		method: "GET",
+		header: http.Header{"Origin": {"https://app.example.com"}},
+		status: http.StatusOK,
+		want: map[string]string{
+			"Access-Control-Allow-Origin": "",
+		},
+	},
+	"preflight": {
+		origins: []string{"*"},
+		method:  "OPTIONS",
+		header: http.Header{
+			"Origin":                         {"https://app.example.com"},
+			"Access-Control-Request-Method":  {"GET"},
+			"Access-Control-Request-Headers": {"range"},
+		},
+		status: http.StatusNoContent,
+		want: map[string]string{
+			"Access-Control-Allow-Origin":  "*",
+			"Access-Control-Allow-Methods": corsMethods,
+			"Access-Control-Allow-Headers": "range",
+			"Access-Control-Max-Age":       corsMaxAge,
+		},
+	},
+	"preflight not listed": {
+		origins: []string{"https://app.example.com"},
+		method:  "OPTIONS",
+		header: http.Header{
+			"Origin":                        {"https://evil.example.com"},
+			"Access-Control-Request-Method": {"GET"},
+		},
+		status: http.StatusForbidden,
+		want: map[string]string{
+			"Access-Control-Allow-Origin":  "",
+			"Access-Control-Allow-Methods": "",
+		},
+	},
+	"options": {
+		origins: []string{"*"},
+		method:  "OPTIONS",
+		status:  http.StatusNoContent,
+		want: map[string]string{
+			"Allow": corsMethods,
+		},
+	},
+}
+
+func TestCORS(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			t.Error("OPTIONS request passed to handler")
+		}
+	})
+
+	for label, tt := range corsTests {
+		t.Run(label, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, "/react@15.6.2/index.js", nil)
+			for k, v := range tt.header {
+				r.Header[k] = v
+			}
+			newCORS(next, tt.origins).ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			for k, want := range tt.want {
+				if got := w.Header().Get(k); got != want {
+					t.Errorf("%s = %q, want %q", k, got, want)
+				}
+			}
+		})
+	}
+}
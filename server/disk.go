@@ -0,0 +1,391 @@
+package server
+
+import (
+	"container/list"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// evictedPrefix is the prefix of directories holding evicted packages
+// until they are removed
+const evictedPrefix = ".evicted-"
+
+// touchInterval is how often the modification time of a package directory
+// is updated on access, persisting recency across restarts
+const touchInterval = time.Minute
+
+// diskCache limits the size of the cache directory by evicting the least
+// recently used packages, along with files generated from them. Packages in
+// use by requests are never evicted.
+//
+// Blobs linked by package files count once towards the size, and are
+// removed once no package links them.
+//
+// A nil diskCache doesn't limit the size.
+type diskCache struct {
+	dir     string
+	quota   int64
+	onEvict func(name string) // called with the package directory name
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*diskEntry // keyed by package directory name
+	lru     *list.List            // of *diskEntry, most recently used first
+	blobs   map[string]*diskBlob  // keyed by blob name
+}
+
+// diskEntry is a package directory in the cache directory
+type diskEntry struct {
+	name    string
+	size    int64 // including generated files, excluding blobs
+	present bool  // extracted to disk
+	refs    int   // requests using the package
+	blobs   []string
+	access  time.Time
+	elem    *list.Element
+}
+
+// diskBlob is a blob linked by package files
+type diskBlob struct {
+	size int64
+	refs int // package files linking the blob
+}
+
+// newDiskCache tracks the packages in dir, evicting them once their total
+// size exceeds quota bytes. Returns nil if quota isn't positive.
+func newDiskCache(dir string, quota int64) (*diskCache, error) {
+	if quota <= 0 {
+		return nil, nil
+	}
+
+	d := &diskCache{
+		dir:     dir,
+		quota:   quota,
+		entries: make(map[string]*diskEntry),
+		lru:     list.New(),
+		blobs:   make(map[string]*diskBlob),
+	}
+	if err := d.scan(); err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	d.evict()
+	d.mu.Unlock()
+	return d, nil
+}
+
+// scan adds the packages already in the cache directory, using their
+// modification time as the last access, and the blobs they link
+func (d *diskCache) scan() error {
+	infos, err := ioutil.ReadDir(d.dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	blobsDir := filepath.Join(d.dir, blobsDirName)
+	blobs, err := readBlobs(blobsDir)
+	if err != nil {
+		return err
+	}
+
+	var entries []*diskEntry
+	for _, fi := range infos {
+		name := fi.Name()
+		switch {
+		case strings.HasPrefix(name, evictedPrefix):
+			// Removal was interrupted
+			if err := os.RemoveAll(filepath.Join(d.dir, name)); err != nil {
+				return err
+			}
+			continue
+		case strings.HasPrefix(name, "."), name == generatedDirName, name == blobsDirName, !fi.IsDir():
+			continue
+		}
+
+		size, refs := linkedSize(filepath.Join(d.dir, name), blobs)
+		e := &diskEntry{
+			name:    name,
+			size:    size + dirSize(filepath.Join(d.dir, generatedDirName, name)),
+			present: true,
+			access:  fi.ModTime(),
+		}
+		d.link(e, refs)
+		entries = append(entries, e)
+	}
+
+	// Remove blobs no longer linked by any package
+	for _, candidates := range blobs {
+		for _, b := range candidates {
+			if _, ok := d.blobs[b.name]; !ok {
+				if err := os.Remove(filepath.Join(blobsDir, b.name[:2], b.name)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// Remove generated files of packages that are no longer cached
+	generated, err := ioutil.ReadDir(filepath.Join(d.dir, generatedDirName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, fi := range generated {
+		if _, err := os.Stat(filepath.Join(d.dir, fi.Name())); os.IsNotExist(err) {
+			if err := os.RemoveAll(filepath.Join(d.dir, generatedDirName, fi.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].access.Before(entries[j].access)
+	})
+	for _, e := range entries {
+		e.elem = d.lru.PushFront(e)
+		d.entries[e.name] = e
+		d.size += e.size
+	}
+	return nil
+}
+
+// acquire marks the package directory name as used, preventing its
+// eviction until the returned function is called
+func (d *diskCache) acquire(name string) (release func()) {
+	if d == nil {
+		return func() {}
+	}
+
+	now := time.Now()
+
+	d.mu.Lock()
+	e, ok := d.entries[name]
+	if ok {
+		d.lru.MoveToFront(e.elem)
+	} else {
+		e = &diskEntry{name: name}
+		e.elem = d.lru.PushFront(e)
+		d.entries[name] = e
+	}
+	e.refs++
+	touch := e.present && now.Sub(e.access) > touchInterval
+	e.access = now
+	d.mu.Unlock()
+
+	if touch {
+		os.Chtimes(filepath.Join(d.dir, name), now, now)
+	}
+
+	return func() { d.release(e) }
+}
+
+func (d *diskCache) release(e *diskEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	e.refs--
+	if e.refs == 0 && !e.present {
+		// Download failed
+		d.lru.Remove(e.elem)
+		delete(d.entries, e.name)
+		d.unlink(e)
+	}
+	d.evict()
+}
+
+// grow records that n bytes were written for the package directory name.
+// The package must be acquired.
+func (d *diskCache) grow(name string, n int64) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	e, ok := d.entries[name]
+	if !ok {
+		return
+	}
+	e.present = true
+	e.size += n
+	d.size += n
+	d.evict()
+}
+
+// addBlobs records that files of the package directory name are hardlinked
+// to refs. The package must be acquired.
+//
+// Blobs may have been removed by evictions since the files were linked.
+// They're checked, and added again if needed, with d.mu held, so that they
+// can't be removed again before they're recorded.
+func (d *diskCache) addBlobs(name string, refs []blobRef) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if e, ok := d.entries[name]; ok {
+		for _, ref := range refs {
+			if err := relinkBlob(ref, filepath.Join(d.dir, blobsDirName)); err != nil {
+				log.Printf("Error linking %q to its blob: %v\n", ref.path, err)
+			}
+		}
+		d.link(e, refs)
+		d.evict()
+	}
+}
+
+// link adds the references of e to blobs, counting blobs not linked by
+// another package towards the size. d.mu must be held.
+func (d *diskCache) link(e *diskEntry, refs []blobRef) {
+	for _, ref := range refs {
+		b, ok := d.blobs[ref.name]
+		if !ok {
+			b = &diskBlob{size: ref.size}
+			d.blobs[ref.name] = b
+			d.size += b.size
+		}
+		b.refs++
+		e.blobs = append(e.blobs, ref.name)
+	}
+}
+
+// unlink drops the references of e to blobs, removing blobs no longer
+// linked by any package. d.mu must be held.
+func (d *diskCache) unlink(e *diskEntry) {
+	for _, name := range e.blobs {
+		b := d.blobs[name]
+		if b.refs--; b.refs > 0 {
+			continue
+		}
+
+		err := os.Remove(filepath.Join(d.dir, blobsDirName, name[:2], name))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Error removing blob %q: %v\n", name, err)
+			continue
+		}
+		delete(d.blobs, name)
+		d.size -= b.size
+	}
+	e.blobs = nil
+}
+
+// evict removes the least recently used packages not in use until the
+// size is within the quota. d.mu must be held.
+func (d *diskCache) evict() {
+	for el := d.lru.Back(); el != nil && d.size > d.quota; {
+		e := el.Value.(*diskEntry)
+		el = el.Prev()
+		if e.refs > 0 || !e.present {
+			continue
+		}
+
+		if err := d.remove(e.name); err != nil {
+			log.Printf("Error evicting %q: %v\n", e.name, err)
+			continue
+		}
+		d.lru.Remove(e.elem)
+		delete(d.entries, e.name)
+		d.size -= e.size
+		d.unlink(e)
+		if d.onEvict != nil {
+			d.onEvict(e.name)
+		}
+	}
+}
+
+// remove moves the package directory name and its generated files out of
+// the way and deletes them in the background. d.mu must be held, so that a
+// request can't acquire the package while it's being moved.
+func (d *diskCache) remove(name string) error {
+	trash, err := ioutil.TempDir(d.dir, evictedPrefix)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(filepath.Join(d.dir, name), filepath.Join(trash, "package"))
+	if err != nil && !os.IsNotExist(err) {
+		os.Remove(trash)
+		return err
+	}
+	err = os.Rename(filepath.Join(d.dir, generatedDirName, name), filepath.Join(trash, "generated"))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error evicting generated files of %q: %v\n", name, err)
+	}
+
+	go func() {
+		if err := os.RemoveAll(trash); err != nil {
+			log.Printf("Error removing evicted %q: %v\n", name, err)
+		}
+	}()
+	return nil
+}
+
+// blobFile is a blob found by readBlobs
+type blobFile struct {
+	name string
+	fi   os.FileInfo
+}
+
+// readBlobs returns the blobs in dir by size
+func readBlobs(dir string) (map[int64][]blobFile, error) {
+	blobs := make(map[int64][]blobFile)
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(fi.Name(), ".") {
+			return nil // Temporary link, see removeBlobTemp
+		}
+		blobs[fi.Size()] = append(blobs[fi.Size()], blobFile{name: fi.Name(), fi: fi})
+		return nil
+	})
+	return blobs, err
+}
+
+// linkedSize returns the total size of the files in dir that aren't
+// hardlinks to blobs, and references to the blobs of those that are
+func linkedSize(dir string, blobs map[int64][]blobFile) (size int64, refs []blobRef) {
+	filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return nil
+		}
+		for _, b := range blobs[fi.Size()] {
+			if os.SameFile(fi, b.fi) {
+				refs = append(refs, blobRef{name: b.name, size: fi.Size()})
+				return nil
+			}
+		}
+		size += fi.Size()
+		return nil
+	})
+	return size, refs
+}
+
+// dirSize returns the total size of the files in dir, or 0 if it doesn't
+// exist
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writePackage creates a package directory name in dir containing size
+// bytes, last accessed at modTime
+func writePackage(t *testing.T, dir, name string, size int, modTime time.Time) {
+	p := filepath.Join(dir, name)
+	if err := os.MkdirAll(p, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(p, "index.js"), []byte(strings.Repeat("x", size)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(p, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func exists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+func TestDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	writePackage(t, dir, "old-1.0.0", 100, now.Add(-3*time.Hour))
+	writePackage(t, dir, "mid-1.0.0", 100, now.Add(-2*time.Hour))
+	writePackage(t, dir, "new-1.0.0", 100, now.Add(-time.Hour))
+	generated := filepath.Join(dir, generatedDirName)
+	for _, name := range []string{"old-1.0.0", "mid-1.0.0", "orphan-1.0.0"} {
+		if err := os.MkdirAll(filepath.Join(generated, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Over quota at startup, the oldest package is evicted
+	d, err := newDiskCache(dir, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var evicted []string
+	d.onEvict = func(name string) { evicted = append(evicted, name) }
+
+	if exists(filepath.Join(dir, "old-1.0.0")) || exists(filepath.Join(generated, "old-1.0.0")) {
+		t.Error("least recently used package not evicted at startup")
+	}
+	if exists(filepath.Join(generated, "orphan-1.0.0")) {
+		t.Error("generated files of missing package not removed")
+	}
+	if !exists(filepath.Join(dir, "mid-1.0.0")) || !exists(filepath.Join(dir, "new-1.0.0")) {
+		t.Fatal("packages within quota evicted")
+	}
+
+	// Packages in use are skipped, even if least recently used
+	releaseMid := d.acquire("mid-1.0.0")
+	release := d.acquire("added-1.0.0")
+	writePackage(t, dir, "added-1.0.0", 100, now)
+	d.grow("added-1.0.0", 100)
+	release()
+
+	if !exists(filepath.Join(dir, "mid-1.0.0")) {
+		t.Error("package in use evicted")
+	}
+	if exists(filepath.Join(dir, "new-1.0.0")) {
+		t.Error("least recently used package not in use wasn't evicted")
+	}
+
+	// Once released, it can be evicted
+	releaseMid()
+	d.acquire("failed-1.0.0")() // Failed downloads aren't tracked
+	d.grow("new-2.0.0", 1000)   // Ignored as it wasn't acquired
+	release = d.acquire("added-2.0.0")
+	writePackage(t, dir, "added-2.0.0", 100, now)
+	d.grow("added-2.0.0", 100)
+	release()
+
+	if exists(filepath.Join(dir, "mid-1.0.0")) {
+		t.Error("released package not evicted")
+	}
+	if want := []string{"new-1.0.0", "mid-1.0.0"}; strings.Join(evicted, ",") != strings.Join(want, ",") {
+		t.Errorf("evicted %q, want %q", evicted, want)
+	}
+	if d.size != 200 || len(d.entries) != 2 {
+		t.Errorf("size = %d with %d entries, want 200 with 2", d.size, len(d.entries))
+	}
+}
+
+func TestDiskCacheUnlimited(t *testing.T) {
+	d, err := newDiskCache("unused", 0)
+	if d != nil || err != nil {
+		t.Fatalf("newDiskCache() = %v, %v, want nil, nil", d, err)
+	}
+
+	// Methods are safe to call on a nil diskCache
+	d.acquire("pkg-1.0.0")()
+	d.grow("pkg-1.0.0", 100)
+}
+
+func TestDiskCacheBlobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blobsDir := filepath.Join(dir, blobsDirName)
+
+	shared := strings.Repeat("s", 100)
+	writeFiles(t, filepath.Join(dir, "pkg-1.0.0"), map[string]string{"index.js": shared, "a.js": strings.Repeat("1", 10)})
+	if _, err := dedupe(filepath.Join(dir, "pkg-1.0.0"), blobsDir); err != nil {
+		t.Fatal(err)
+	}
+	// Left by a package removed while the server wasn't running
+	writeFiles(t, filepath.Join(dir, "gone-1.0.0"), map[string]string{"gone.js": "gone"})
+	if _, err := dedupe(filepath.Join(dir, "gone-1.0.0"), blobsDir); err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(filepath.Join(dir, "gone-1.0.0"))
+
+	d, err := newDiskCache(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.size != 110 || len(d.blobs) != 2 {
+		t.Errorf("size = %d with %d blobs after scan, want 110 with 2", d.size, len(d.blobs))
+	}
+
+	// Files shared with a cached version count once
+	release := d.acquire("pkg-2.0.0")
+	writeFiles(t, filepath.Join(dir, "pkg-2.0.0"), map[string]string{"index.js": shared, "a.js": strings.Repeat("2", 10)})
+	refs, err := dedupe(filepath.Join(dir, "pkg-2.0.0"), blobsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.addBlobs("pkg-2.0.0", refs)
+	d.grow("pkg-2.0.0", dirSize(filepath.Join(dir, "pkg-2.0.0"))-refsSize(refs))
+	release()
+	if d.size != 120 {
+		t.Errorf("size = %d, want 120", d.size)
+	}
+
+	blobCount := func() int {
+		blobs, err := readBlobs(blobsDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, candidates := range blobs {
+			n += len(candidates)
+		}
+		return n
+	}
+	if n := blobCount(); n != 3 {
+		t.Errorf("%d blobs stored, want 3", n)
+	}
+
+	// Evicting a version keeps blobs linked by the other
+	d.mu.Lock()
+	d.quota = 115
+	d.evict()
+	d.mu.Unlock()
+	if exists(filepath.Join(dir, "pkg-1.0.0")) {
+		t.Fatal("least recently used package not evicted")
+	}
+	if n := blobCount(); n != 2 || d.size != 110 {
+		t.Errorf("%d blobs stored with size %d after evicting one version, want 2 with 110", n, d.size)
+	}
+
+	d.mu.Lock()
+	d.quota = 0
+	d.evict()
+	d.mu.Unlock()
+	if n := blobCount(); n != 0 || d.size != 0 || len(d.blobs) != 0 {
+		t.Errorf("%d blobs stored with size %d after evicting all versions, want none", n, d.size)
+	}
+
+	// Blobs removed between dedupe and addBlobs are added again
+	d.mu.Lock()
+	d.quota = 1000
+	d.mu.Unlock()
+	release = d.acquire("pkg-3.0.0")
+	writeFiles(t, filepath.Join(dir, "pkg-3.0.0"), map[string]string{"index.js": shared})
+	if refs, err = dedupe(filepath.Join(dir, "pkg-3.0.0"), blobsDir); err != nil {
+		t.Fatal(err)
+	}
+	d.addBlobs("pkg-3.0.0", refs)
+	d.grow("pkg-3.0.0", 0)
+	release()
+
+	release = d.acquire("pkg-4.0.0")
+	defer release()
+	writeFiles(t, filepath.Join(dir, "pkg-4.0.0"), map[string]string{"index.js": shared})
+	if refs, err = dedupe(filepath.Join(dir, "pkg-4.0.0"), blobsDir); err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	d.quota = 0
+	d.evict()
+	d.mu.Unlock()
+	if n := blobCount(); n != 0 {
+		t.Fatalf("%d blobs stored after evicting the package linking them, want none", n)
+	}
+	d.addBlobs("pkg-4.0.0", refs)
+	if n := blobCount(); n != 1 || d.size != 100 {
+		t.Errorf("%d blobs stored with size %d after adding removed blob, want 1 with 100", n, d.size)
+	}
+	if !sameFile(t, filepath.Join(dir, "pkg-4.0.0", "index.js"), filepath.Join(blobsDir, refs[0].name[:2], refs[0].name)) {
+		t.Error("package file not linked to added blob")
+	}
+}
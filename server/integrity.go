@@ -0,0 +1,178 @@
+package server
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/vcabbage/go-unpkg/npm"
+)
+
+// integrityFile is the file in a package's generated directory mapping each
+// file in the package to its Subresource Integrity hash
+const integrityFile = "integrity.json"
+
+// integrityHeader is the response header containing the Subresource
+// Integrity hash of served files
+const integrityHeader = "Integrity"
+
+// serveIntegrity sends the Subresource Integrity hash of the file at p as
+// plain text
+func (h *handler) serveIntegrity(w http.ResponseWriter, r *http.Request, pkg *npm.Package, fsys fs.FS, p string) {
+	sri, ok := h.fileIntegrity(pkg, fsys, p)
+	if !ok {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, sri)
+}
+
+// fileIntegrity returns the Subresource Integrity hash of the file at p in
+// pkg, or false if p isn't a file
+func (h *handler) fileIntegrity(pkg *npm.Package, fsys fs.FS, p string) (string, bool) {
+	hashes, err := h.packageIntegrity(pkg, fsys)
+	if err != nil {
+		log.Printf("Error reading integrity for %q %s: %v\n", pkg.Name, pkg.Version, err)
+		return "", false
+	}
+	sri, ok := hashes[path.Clean("/"+p)]
+	return sri, ok
+}
+
+// packageIntegrity returns the hashes of all files in pkg, loading them
+// from the generated directory or computing them from the package files
+// fsys if they don't exist
+func (h *handler) packageIntegrity(pkg *npm.Package, fsys fs.FS) (map[string]string, error) {
+	pkgDir := filepath.Join(h.cacheDir, pkgDirName(pkg.Name, pkg.Version))
+
+	h.integrityMu.RLock()
+	hashes, ok := h.integrity[pkgDir]
+	h.integrityMu.RUnlock()
+	if ok {
+		return hashes, nil
+	}
+
+	dest := filepath.Join(h.generatedDir(pkg), integrityFile)
+	b, err := ioutil.ReadFile(dest)
+	switch {
+	case err == nil:
+		err = json.Unmarshal(b, &hashes)
+	case os.IsNotExist(err):
+		hashes, err = h.buildIntegrity(pkg, fsys, dest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if h.disk == nil {
+		// Without a size limit nothing is evicted to forget the hashes on,
+		// so they're read from dest on each request instead
+		return hashes, nil
+	}
+
+	h.integrityMu.Lock()
+	if h.integrity == nil {
+		h.integrity = make(map[string]map[string]string)
+	}
+	h.integrity[pkgDir] = hashes
+	h.integrityMu.Unlock()
+
+	return hashes, nil
+}
+
+// buildIntegrity hashes every file of pkg in the package files fsys and
+// writes the result to dest
+func (h *handler) buildIntegrity(pkg *npm.Package, fsys fs.FS, dest string) (map[string]string, error) {
+	// Use singleflight to supress hashing the same package concurrently
+	v, err, _ := h.sf.Do(dest, func() (interface{}, error) {
+		hashes := make(map[string]string)
+		err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.Type()&fs.ModeSymlink != 0 {
+				fi, err := fs.Stat(fsys, p)
+				if err != nil || !fi.Mode().IsRegular() {
+					return nil // Broken link, or directory which WalkDir doesn't follow
+				}
+			} else if !d.Type().IsRegular() {
+				return nil
+			}
+
+			sri, err := hashFile(fsys, p)
+			if err != nil {
+				return err
+			}
+			hashes["/"+p] = sri
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := json.Marshal(hashes)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeFileAtomic(dest, b); err != nil {
+			return nil, err
+		}
+		h.generated(pkg, dest)
+		return hashes, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(map[string]string), nil
+}
+
+// hashFile returns the sha384 Subresource Integrity hash of the file at p
+// within fsys
+func hashFile(fsys fs.FS, p string) (string, error) {
+	f, err := fsys.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha512.New384()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha384-" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to dest,
+// so that partially written files are never served
+func writeFileAtomic(dest string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := tmp.Write(data); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
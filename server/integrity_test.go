@@ -0,0 +1,85 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vcabbage/go-unpkg/npm"
+)
+
+func TestIntegrity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "integrity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pkg := &npm.Package{Name: "@test/pkg", Version: "1.0.0"}
+	pkgDir := filepath.Join(dir, pkgDirName(pkg.Name, pkg.Version))
+	if err := os.MkdirAll(filepath.Join(pkgDir, "lib"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(pkgDir, "lib", "index.js"), []byte("alert('Hello, World!');"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	const want = "sha384-Bg9twQOyM+pxvxdZFXOxQ8mzISbQpouZ9Miui8VIeVuTR6/BlDEK6CCrnZmaL6iB"
+
+	h := &handler{cacheDir: dir}
+	tests := map[string]struct {
+		path        string
+		query       bool
+		ifNoneMatch string
+		status      int
+		body        string
+	}{
+		"header":            {path: "/lib/index.js", status: http.StatusOK, body: "alert('Hello, World!');"},
+		"not modified":      {path: "/lib/index.js", ifNoneMatch: `"` + want + `"`, status: http.StatusNotModified},
+		"query":             {path: "/lib/index.js", query: true, status: http.StatusOK, body: want},
+		"query,unclean":     {path: "lib//index.js", query: true, status: http.StatusOK, body: want},
+		"query,directory":   {path: "/lib", query: true, status: http.StatusNotFound},
+		"query,nonexistent": {path: "/missing.js", query: true, status: http.StatusNotFound},
+	}
+	for label, tt := range tests {
+		t.Run(label, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			if tt.query {
+				h.serveIntegrity(w, r, pkg, os.DirFS(pkgDir), tt.path)
+			} else {
+				h.serveFile(w, r, pkg, os.DirFS(pkgDir), tt.path)
+				if got := w.Header().Get(integrityHeader); got != want {
+					t.Errorf("%s header = %q, want %q", integrityHeader, got, want)
+				}
+				if got := w.Header().Get("ETag"); got != `"`+want+`"` {
+					t.Errorf("ETag header = %q, want %q", got, `"`+want+`"`)
+				}
+				if got := w.Header().Get("Cache-Control"); got != immutable {
+					t.Errorf("Cache-Control header = %q, want %q", got, immutable)
+				}
+			}
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.body)
+			}
+		})
+	}
+
+	// Hashes are persisted in the generated directory
+	if _, err := os.Stat(filepath.Join(h.generatedDir(pkg), integrityFile)); err != nil {
+		t.Errorf("integrity manifest not written: %v", err)
+	}
+	// and not held in memory, as without -cacheSize packages aren't evicted
+	if len(h.integrity) != 0 {
+		t.Errorf("integrity of %d packages held in memory, want 0", len(h.integrity))
+	}
+}
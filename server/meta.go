@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/vcabbage/go-unpkg/npm"
+)
+
+// fileMeta describes a file in a package for ?meta responses
+type fileMeta struct {
+	Path         string `json:"path"`
+	Type         string `json:"type"`
+	ContentType  string `json:"contentType"`
+	Size         int64  `json:"size"`
+	LastModified string `json:"lastModified"`
+	Integrity    string `json:"integrity"`
+}
+
+// dirMeta describes a directory in a package for ?meta responses
+type dirMeta struct {
+	Path  string        `json:"path"`
+	Type  string        `json:"type"`
+	Files []interface{} `json:"files"`
+}
+
+// serveMeta sends JSON metadata for the file or directory tree at p within
+// the package files fsys of pkg
+func (h *handler) serveMeta(w http.ResponseWriter, r *http.Request, pkg *npm.Package, fsys fs.FS, p string) {
+	p = path.Clean("/" + p)
+	hashes, err := h.packageIntegrity(pkg, fsys)
+	if err != nil {
+		log.Printf("Error reading integrity for %q %s: %v\n", pkg.Name, pkg.Version, err)
+		http.Error(w, "error reading metadata", http.StatusInternalServerError)
+		return
+	}
+
+	m, err := readMeta(fsys, p, hashes)
+	if os.IsNotExist(err) {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading metadata for %q: %v\n", p, err)
+		http.Error(w, "error reading metadata", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(m); err != nil {
+		log.Println("Error writing metadata:", err)
+	}
+}
+
+// readMeta returns the metadata for p, recursing into directories. The
+// integrity of files is looked up in hashes, as built by buildIntegrity.
+func readMeta(fsys fs.FS, p string, hashes map[string]string) (interface{}, error) {
+	fi, err := fs.Stat(fsys, fsPath(p))
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.IsDir() {
+		return readFileMeta(fsys, p, fi, hashes[p])
+	}
+
+	entries, err := fs.ReadDir(fsys, fsPath(p))
+	if err != nil {
+		return nil, err
+	}
+
+	d := &dirMeta{Path: p, Type: "directory", Files: make([]interface{}, 0, len(entries))}
+	for _, e := range entries {
+		m, err := readMeta(fsys, path.Join(p, e.Name()), hashes)
+		if err != nil {
+			return nil, err
+		}
+		d.Files = append(d.Files, m)
+	}
+	return d, nil
+}
+
+// readFileMeta returns the metadata for the file p with integrity sri
+func readFileMeta(fsys fs.FS, p string, fi fs.FileInfo, sri string) (*fileMeta, error) {
+	ct := contentType(p)
+	if ct == "" {
+		// Sniff the content type as the extension is unknown
+		f, err := fsys.Open(fsPath(p))
+		if err != nil {
+			return nil, err
+		}
+		head := make([]byte, 512)
+		n, err := io.ReadFull(f, head)
+		f.Close()
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		ct = http.DetectContentType(head[:n])
+	}
+
+	return &fileMeta{
+		Path:         p,
+		Type:         "file",
+		ContentType:  ct,
+		Size:         fi.Size(),
+		LastModified: fi.ModTime().UTC().Format(http.TimeFormat),
+		Integrity:    sri,
+	}, nil
+}
+
+// contentType returns the content type for p based on its extension, or
+// "" if unknown
+func contentType(p string) string {
+	ext := strings.ToLower(path.Ext(p))
+	if ct, ok := fileTypes[ext]; ok {
+		return ct
+	}
+	return mime.TypeByExtension(ext)
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vcabbage/go-unpkg/npm"
+)
+
+func TestServeMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pkg := &npm.Package{Name: "pkg", Version: "1.0.0"}
+	pkgDir := filepath.Join(dir, pkgDirName(pkg.Name, pkg.Version))
+	writeFiles(t, pkgDir, map[string]string{"dist/index.js": "hello", "README.md": ""})
+	h := &handler{cacheDir: dir}
+
+	w := httptest.NewRecorder()
+	h.serveMeta(w, httptest.NewRequest("GET", "/pkg@1.0.0/?meta", nil), pkg, os.DirFS(pkgDir), "/")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var got struct {
+		Path  string
+		Type  string
+		Files []struct {
+			Path        string
+			Type        string
+			ContentType string
+			Size        int64
+			Integrity   string
+			Files       []struct {
+				Path        string
+				ContentType string
+				Size        int64
+				Integrity   string
+			}
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Path != "/" || got.Type != "directory" || len(got.Files) != 2 {
+		t.Fatalf("meta = %+v, want root directory with 2 entries", got)
+	}
+	readme, dist := got.Files[0], got.Files[1]
+	if readme.Path != "/README.md" || readme.ContentType != "text/x-markdown" || readme.Size != 0 {
+		t.Errorf("README.md meta = %+v", readme)
+	}
+	if dist.Path != "/dist" || dist.Type != "directory" || len(dist.Files) != 1 {
+		t.Fatalf("dist meta = %+v", dist)
+	}
+	index := dist.Files[0]
+	// echo -n hello | openssl dgst -sha384 -binary | base64
+	wantIntegrity := "sha384-WeF0h3dEjGnea4ANejO7+5/xtGPkQ1TDVTvNucZm+pASWjx5+QOXvfX2oT3oKGhP"
+	if index.Path != "/dist/index.js" || index.Size != 5 || index.Integrity != wantIntegrity {
+		t.Errorf("index.js meta = %+v", index)
+	}
+
+	// Hashes are stored with the package's integrity, not computed per request
+	if _, err := os.Stat(filepath.Join(h.generatedDir(pkg), integrityFile)); err != nil {
+		t.Errorf("integrity not stored: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	h.serveMeta(w, httptest.NewRequest("GET", "/pkg@1.0.0/missing?meta", nil), pkg, os.DirFS(pkgDir), "/missing")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("missing status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/vcabbage/go-unpkg/esm"
+	"github.com/vcabbage/go-unpkg/npm"
+)
+
+// moduleExtensions are the file extensions rewritten in module mode
+var moduleExtensions = map[string]bool{
+	".js":  true,
+	".mjs": true,
+}
+
+// serveModule sends the file at p within the package files fsys with its
+// imports rewritten to URLs browsers can load, building and caching it on
+// first request. Files that aren't JavaScript are sent as is.
+func (h *handler) serveModule(w http.ResponseWriter, r *http.Request, pkg *npm.Package, fsys fs.FS, p string) {
+	p = path.Clean("/" + p)
+	if !moduleExtensions[strings.ToLower(path.Ext(p))] || !isFile(fsys, p) {
+		h.serveFile(w, r, pkg, fsys, p)
+		return
+	}
+
+	modulePath := filepath.Join(h.generatedDir(pkg), "module", filepath.FromSlash(p))
+	if _, err := os.Stat(modulePath); os.IsNotExist(err) {
+		// Use singleflight to supress transforming the same file concurrently
+		_, err, _ := h.sf.Do(modulePath, func() (interface{}, error) {
+			if err := h.buildModule(pkg, fsys, p, modulePath); err != nil {
+				return nil, err
+			}
+			h.generated(pkg, modulePath)
+			return nil, nil
+		})
+		if err != nil {
+			log.Printf("Error rewriting imports in %q: %v\n", p, err)
+			http.Error(w, "error rewriting imports", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// The output embeds the dependency versions resolved when it was built,
+	// which change once rebuilt, so it's cached like redirects from ranges
+	w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(h.redirectAge.Seconds())))
+	h.serveContent(w, r, pkg, p, os.DirFS(filepath.Dir(modulePath)), filepath.Base(modulePath), modulePath)
+}
+
+// buildModule rewrites the imports of the file at p within the package
+// files fsys and writes the result to dest
+func (h *handler) buildModule(pkg *npm.Package, fsys fs.FS, p, dest string) error {
+	src, err := fs.ReadFile(fsys, fsPath(p))
+	if err != nil {
+		return err
+	}
+
+	var (
+		buf  bytes.Buffer
+		last int
+	)
+	for _, imp := range esm.Imports(src) {
+		buf.Write(src[last:imp.Start])
+		buf.WriteString(h.rewriteSpecifier(pkg, fsys, p, imp.Specifier))
+		last = imp.End
+	}
+	buf.Write(src[last:])
+
+	return writeFileAtomic(dest, buf.Bytes())
+}
+
+// rewriteSpecifier returns the URL to import spec from the file p of pkg.
+//
+// Relative specifiers are resolved within the package and bare specifiers
+// to the version of the dependency satisfying the range in package.json.
+// URLs, absolute paths and bare specifiers that aren't dependencies, such
+// as Node builtins, are unchanged.
+func (h *handler) rewriteSpecifier(pkg *npm.Package, fsys fs.FS, p, spec string) string {
+	switch {
+	case strings.HasPrefix(spec, "./"), strings.HasPrefix(spec, "../"):
+		target := path.Join(path.Dir(p), spec)
+		if resolved, ok := resolveFile(fsys, target); ok {
+			target = resolved
+		}
+		return unpkgURL(pkg.Name, pkg.Version, target) + "?module"
+	case strings.HasPrefix(spec, "/"), strings.Contains(spec, ":"):
+		return spec
+	}
+
+	name, subpath := splitSpecifier(spec)
+	if name == pkg.Name {
+		// Self reference
+		return unpkgURL(pkg.Name, pkg.Version, subpath) + "?module"
+	}
+
+	rng, ok := pkg.Dependency(name)
+	if !ok {
+		return spec
+	}
+	dep, err := h.c.lookupPackage(name, rng)
+	if err != nil {
+		// Let the import request resolve the range
+		log.Printf("Error resolving import %q %s of %q: %v\n", name, rng, pkg.Name, err)
+		return unpkgURL(name, url.PathEscape(rng), subpath) + "?module"
+	}
+	return unpkgURL(dep.Name, dep.Version, subpath) + "?module"
+}
+
+// splitSpecifier splits a bare specifier into the package name, which may
+// be scoped, and the path within the package
+func splitSpecifier(spec string) (name, subpath string) {
+	parts := strings.SplitN(spec, "/", 3)
+	if strings.HasPrefix(spec, "@") && len(parts) > 1 {
+		name = parts[0] + "/" + parts[1]
+		if len(parts) == 3 {
+			subpath = "/" + parts[2]
+		}
+		return name, subpath
+	}
+
+	if i := strings.IndexByte(spec, '/'); i >= 0 {
+		return spec[:i], spec[i:]
+	}
+	return spec, ""
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vcabbage/go-unpkg/npm"
+)
+
+var splitSpecifierTests = map[string]struct {
+	in      string
+	name    string
+	subpath string
+}{
+	"name":           {in: "react", name: "react"},
+	"name,subpath":   {in: "react/jsx-runtime", name: "react", subpath: "/jsx-runtime"},
+	"scoped":         {in: "@babel/runtime", name: "@babel/runtime"},
+	"scoped,subpath": {in: "@babel/runtime/helpers/x.js", name: "@babel/runtime", subpath: "/helpers/x.js"},
+}
+
+func TestSplitSpecifier(t *testing.T) {
+	for label, tt := range splitSpecifierTests {
+		t.Run(label, func(t *testing.T) {
+			name, subpath := splitSpecifier(tt.in)
+			if name != tt.name || subpath != tt.subpath {
+				t.Errorf("splitSpecifier(%s) = %q, %q, want %q, %q", tt.in, name, subpath, tt.name, tt.subpath)
+			}
+		})
+	}
+}
+
+func TestBuildModule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "module")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pkgDir := filepath.Join(dir, "pkg")
+	files := map[string]string{
+		"lib/index.js": `import React from 'react';
+import { render } from "react-dom/server";
+import fs from 'fs';
+import peer from 'undeclared-peer/x';
+import util from './util';
+export * from '../shared/index.mjs';
+const lazy = () => import("https://example.com/x.js");
+`,
+		"lib/util.js":      "",
+		"shared/index.mjs": "",
+	}
+	for name, content := range files {
+		p := filepath.Join(pkgDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := &handler{c: newCache(0, nil, nil), cacheDir: dir}
+	h.c.addPackage(&npm.Package{Name: "react", Version: "15.6.2"}, "^15.0.0")
+	h.c.addPackage(&npm.Package{Name: "react-dom", Version: "15.6.2"}, "^15.6.0")
+
+	pkg := &npm.Package{
+		Name:    "@test/pkg",
+		Version: "1.0.0",
+		Fields: map[string]json.RawMessage{
+			"dependencies": json.RawMessage(`{"react": "^15.0.0", "react-dom": "^15.6.0"}`),
+		},
+	}
+
+	dest := filepath.Join(dir, "out.js")
+	if err := h.buildModule(pkg, os.DirFS(pkgDir), "/lib/index.js", dest); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `import React from '/react@15.6.2?module';
+import { render } from "/react-dom@15.6.2/server?module";
+import fs from 'fs';
+import peer from 'undeclared-peer/x';
+import util from '/@test/pkg@1.0.0/lib/util.js?module';
+export * from '/@test/pkg@1.0.0/shared/index.mjs?module';
+const lazy = () => import("https://example.com/x.js");
+`
+	if string(got) != want {
+		t.Errorf("buildModule() =\n%s\nwant\n%s", got, want)
+	}
+
+	// Dependency versions change, so the output isn't immutable
+	h.redirectAge = time.Minute
+	w := httptest.NewRecorder()
+	h.serveModule(w, httptest.NewRequest("GET", "/@test/pkg@1.0.0/lib/index.js?module", nil), pkg, os.DirFS(pkgDir), "/lib/index.js")
+	if w.Code != http.StatusOK || w.Body.String() != want {
+		t.Errorf("serveModule() = %d %q, want %q", w.Code, w.Body.String(), want)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "public, max-age=60" {
+		t.Errorf("Cache-Control = %q, want public, max-age=60", got)
+	}
+}
@@ -5,8 +5,8 @@ import (
 	"regexp"
 )
 
-// urlRegex parses [/]name[@version][path] into name, version, path
-var urlRegex = regexp.MustCompile("^/?([^@/]+)@?([^/]*)?(/.*)?")
+// urlRegex parses [/][@scope/]name[@version][path] into name, version, path
+var urlRegex = regexp.MustCompile("^/?((?:@[^@/]+/)?[^@/]+)@?([^/]*)?(/.*)?")
 
 type parsed struct {
 	Name    string
@@ -14,7 +14,7 @@ type parsed struct {
 	Path    string
 }
 
-// Parse parses a package@version/file/path into individual parts
+// Parse parses a [@scope/]package@version/file/path into individual parts
 func parseURL(s string) (*parsed, error) {
 	p := &parsed{Version: "latest"} // Default to latest
 
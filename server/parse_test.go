@@ -34,6 +34,26 @@ var parseTests = map[string]struct {
 		in:   "react/dist/react.min.js",
 		want: parsed{Name: "react", Version: "latest", Path: "/dist/react.min.js"},
 	},
+	"scoped name,version,filepath": {
+		in:   "@babel/core@7.0.0/lib/index.js",
+		want: parsed{Name: "@babel/core", Version: "7.0.0", Path: "/lib/index.js"},
+	},
+	"scoped name,pattern version,directory": {
+		in:   "/@types/react@^15.0.0/",
+		want: parsed{Name: "@types/react", Version: "^15.0.0", Path: "/"},
+	},
+	"scoped name only": {
+		in:   "@angular/core",
+		want: parsed{Name: "@angular/core", Version: "latest", Path: ""},
+	},
+	"scoped name,filepath": {
+		in:   "@angular/core/bundles/core.umd.js",
+		want: parsed{Name: "@angular/core", Version: "latest", Path: "/bundles/core.umd.js"},
+	},
+	"scoped name,bad version,filepath": {
+		in:   "@angular/core@/bundles/core.umd.js",
+		want: parsed{Name: "@angular/core", Version: "latest", Path: "/bundles/core.umd.js"},
+	},
 }
 
 func TestParse(t *testing.T) {
@@ -45,3 +65,19 @@ func TestParse(t *testing.T) {
 		})
 	}
 }
+
+var parseErrorTests = map[string]string{
+	"empty":      "",
+	"scope only": "@babel",
+	"scope dir":  "@babel/",
+}
+
+func TestParseError(t *testing.T) {
+	for label, in := range parseErrorTests {
+		t.Run(label, func(t *testing.T) {
+			if got, err := parseURL(in); err == nil {
+				t.Errorf("Parse(%s) = %+v, want error", in, *got)
+			}
+		})
+	}
+}
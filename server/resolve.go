@@ -0,0 +1,90 @@
+package server
+
+import (
+	"encoding/json"
+	"io/fs"
+	"path"
+)
+
+// resolveExtensions are appended, in order, to paths that don't match a file
+var resolveExtensions = []string{".js", ".json", ".mjs", ".cjs"}
+
+// resolveFile resolves p, a path within the package files fsys, to a file as Node resolves
+// modules: the exact file, p with each of resolveExtensions, the main file
+// of p/package.json and finally p/index.js.
+//
+// ok is false if no file is found.
+func resolveFile(fsys fs.FS, p string) (resolved string, ok bool) {
+	if resolved, ok := resolveAsFile(fsys, p); ok {
+		return resolved, true
+	}
+
+	if !isDir(fsys, p) {
+		return "", false
+	}
+
+	if main := dirMain(fsys, p); main != "" {
+		m := path.Join(p, main)
+		if resolved, ok := resolveAsFile(fsys, m); ok {
+			return resolved, true
+		}
+		if index := path.Join(m, "index.js"); isFile(fsys, index) {
+			return index, true
+		}
+	}
+
+	if index := path.Join(p, "index.js"); isFile(fsys, index) {
+		return index, true
+	}
+	return "", false
+}
+
+// resolveAsFile returns p or p with the first of resolveExtensions that
+// is a file
+func resolveAsFile(fsys fs.FS, p string) (string, bool) {
+	if isFile(fsys, p) {
+		return p, true
+	}
+	for _, ext := range resolveExtensions {
+		if isFile(fsys, p+ext) {
+			return p + ext, true
+		}
+	}
+	return "", false
+}
+
+// dirMain returns the main field of the package.json in directory p
+func dirMain(fsys fs.FS, p string) string {
+	f, err := fsys.Open(fsPath(path.Join(p, "package.json")))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	var pkgJSON struct {
+		Main string
+	}
+	if err := json.NewDecoder(f).Decode(&pkgJSON); err != nil {
+		return ""
+	}
+	return pkgJSON.Main
+}
+
+func isFile(fsys fs.FS, p string) bool {
+	fi, err := fs.Stat(fsys, fsPath(p))
+	return err == nil && fi.Mode().IsRegular()
+}
+
+func isDir(fsys fs.FS, p string) bool {
+	fi, err := fs.Stat(fsys, fsPath(p))
+	return err == nil && fi.IsDir()
+}
+
+// fsPath returns the package path p as a path for fs.FS, which are
+// unrooted
+func fsPath(p string) string {
+	if p = path.Clean("/" + p)[1:]; p == "" {
+		return "."
+	}
+	return p
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var resolveFileTests = map[string]struct {
+	in   string
+	want string
+	ok   bool
+}{
+	"exact":              {in: "/fp.js", want: "/fp.js", ok: true},
+	"file before dir":    {in: "/fp", want: "/fp.js", ok: true},
+	"json":               {in: "/data", want: "/data.json", ok: true},
+	"mjs":                {in: "/esm", want: "/esm.mjs", ok: true},
+	"dir package.json":   {in: "/sub", want: "/sub/lib/main.js", ok: true},
+	"dir index":          {in: "/lib", want: "/lib/index.js", ok: true},
+	"dir without index":  {in: "/empty", ok: false},
+	"missing":            {in: "/missing", ok: false},
+	"relative main path": {in: "lib/index", want: "lib/index.js", ok: true},
+}
+
+func TestResolveFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resolve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"fp.js":            "",
+		"fp/index.js":      "",
+		"data.json":        "{}",
+		"esm.mjs":          "",
+		"sub/package.json": `{"main": "./lib/main"}`,
+		"sub/lib/main.js":  "",
+		"lib/index.js":     "",
+		"empty/readme.txt": "",
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for label, tt := range resolveFileTests {
+		t.Run(label, func(t *testing.T) {
+			got, ok := resolveFile(os.DirFS(dir), tt.in)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("resolveFile(%s) = %q, %t, want %q, %t", tt.in, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
@@ -1,18 +1,24 @@
 package server
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/fs"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vcabbage/go-unpkg/extract"
 	"github.com/vcabbage/go-unpkg/npm"
+	"github.com/vcabbage/go-unpkg/storage"
 
 	"os/signal"
 
@@ -38,14 +44,104 @@ func Run() int {
 		cacheTimeout  = flag.Duration("cacheTimeout", 5*time.Minute, "length of time to cache package metadata")
 		listen        = flag.String("listen", "localhost:8080", "Address and port to listen on")
 		enableMetrics = flag.Bool("metrics", true, "enable prometheus metric collection")
+		registry      = flag.String("registry", "", "base URL of the default registry (overrides npmrc)")
+		npmrc         = flag.String("npmrc", "", "path to an .npmrc file configuring registries and credentials")
+		conditions    = flag.String("conditions", strings.Join(npm.DefaultConditions, ","), "package.json exports conditions to match, in order of priority")
+		strictExports = flag.Bool("strictExports", false, "respond 404 for subpaths not exported by packages with an exports field")
+		redirectAge   = flag.Duration("redirectMaxAge", 0, "max-age of redirects from version ranges and tags (default -cacheTimeout)")
+		cacheSize     = flag.Int64("cacheSize", 0, "maximum size of the cache directory in MiB, evicting least recently used packages (0 for unlimited)")
+		sharedCache   = flag.String("sharedCache", "", "directory or s3://bucket/prefix?endpoint=URL&region=REGION caching package files shared between servers")
+		corsOrigins   = flag.String("corsOrigins", "*", "comma separated origins allowed to make cross-origin requests, or * for any")
+		packageFormat = flag.String("packageFormat", "extract", "how downloaded packages are kept: extract, archive to serve files from the tarball, or shared to serve them from -sharedCache")
 	)
 	flag.Parse()
 
-	c := newCache(*cacheTimeout)
+	switch *packageFormat {
+	case "extract", "archive":
+	case "shared":
+		if *sharedCache == "" {
+			log.Println("-packageFormat shared requires -sharedCache")
+			return 1
+		}
+	default:
+		log.Printf("Invalid -packageFormat %q, must be extract, archive or shared\n", *packageFormat)
+		return 1
+	}
+
+	if *redirectAge == 0 {
+		// Clients shouldn't cache a resolved version longer than we do
+		*redirectAge = *cacheTimeout
+	}
+
+	cfg := &npm.Config{}
+	if *npmrc != "" {
+		var err error
+		cfg, err = npm.LoadNPMRC(*npmrc)
+		if err != nil {
+			log.Println("Error loading npmrc:", err)
+			return 1
+		}
+	}
+	if *registry != "" {
+		cfg.Registry = *registry
+	}
+	cfg.SetEnvToken()
+	client := npm.NewClient(*cfg)
+
+	if err := npm.RemoveTemp(*cacheDir); err != nil {
+		log.Println("Error removing incomplete downloads:", err)
+	}
+	if err := storage.RemoveTemp(*cacheDir); err != nil {
+		log.Println("Error removing incomplete downloads:", err)
+	}
+	if err := removeBlobTemp(*cacheDir); err != nil {
+		log.Println("Error removing incomplete blob links:", err)
+	}
+
+	shared, err := storage.Parse(*sharedCache)
+	if err != nil {
+		log.Println("Error parsing shared cache:", err)
+		return 1
+	}
+
+	if err := os.MkdirAll(*cacheDir, 0755); err != nil {
+		log.Println("Error creating cache directory:", err)
+		return 1
+	}
+	store, err := openPackageStore(filepath.Join(*cacheDir, packageStoreFile))
+	if err != nil {
+		log.Println("Error opening package store:", err)
+		return 1
+	}
+	defer store.Close()
+
+	c := newCache(*cacheTimeout, client, store)
+
+	disk, err := newDiskCache(*cacheDir, *cacheSize<<20)
+	if err != nil {
+		log.Println("Error reading cache directory:", err)
+		return 1
+	}
+
+	h := &handler{
+		c:             c,
+		registry:      client,
+		cacheDir:      *cacheDir,
+		disk:          disk,
+		shared:        shared,
+		conditions:    strings.Split(*conditions, ","),
+		strictExports: *strictExports,
+		redirectAge:   *redirectAge,
+		archive:       *packageFormat == "archive",
+		serveShared:   *packageFormat == "shared",
+	}
+	if disk != nil {
+		disk.onEvict = h.evicted
+	}
 
 	mux := http.NewServeMux()
 
-	mux.Handle("/", &handler{c: c, cacheDir: *cacheDir})
+	mux.Handle("/", newCORS(h, strings.Split(*corsOrigins, ",")))
 
 	if *enableMetrics {
 		mux.Handle("/metrics", prometheus.Handler())
@@ -69,7 +165,7 @@ func Run() int {
 
 	log.Printf("Listening on %s...\n", srv.Addr)
 
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt)
 	<-sig
 	log.Println("Shutting down...")
@@ -79,8 +175,33 @@ func Run() int {
 // handler contains dependencies shared between all requests
 type handler struct {
 	c        *cache
+	registry *npm.Client
 	cacheDir string
+	disk     *diskCache
+	shared   storage.Storage // second-level cache shared with other servers, may be nil
 	sf       singleflight.Group
+
+	// used to resolve the package.json exports field
+	conditions    []string
+	strictExports bool
+
+	// max-age of redirects to the version satisfying a range or tag
+	redirectAge time.Duration
+
+	// per-file integrity hashes, keyed by package directory. Only held
+	// when disk is set, as they're forgotten when packages are evicted.
+	integrityMu sync.RWMutex
+	integrity   map[string]map[string]string
+
+	// download packages as indexed tarballs rather than extracting them
+	archive bool
+	// serve package files from shared rather than the cache directory
+	serveShared bool
+
+	// open archives, keyed by package directory, until evicted. Unused
+	// without -cacheSize.
+	archivesMu sync.Mutex
+	archives   map[string]*extract.Archive
 }
 
 // ServeHTTP handles each request to the server in a seperate goroutine
@@ -96,34 +217,67 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fmt.Println(parsed)
-
-	// Get the package metadata from the cache
-	pkg, err := h.c.getPackage(parsed.Name, parsed.Version)
-	if err != nil {
-		// Not in cache
-		pkg, err = npm.GetMetadata(parsed.Name, parsed.Version)
-		if err != nil {
-			log.Println("Error resolving package:", err)
-			// TODO: Don't pass the raw error through
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		h.c.addPackage(pkg, parsed.Version)
+	// Get the package metadata from the cache, or resolve if not cached
+	pkg, err := h.c.lookupPackage(parsed.Name, parsed.Version)
+	switch err {
+	case nil:
+	case npm.ErrNotFound, npm.ErrInvalidVersion:
+		log.Println("Error resolving package:", err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	default:
+		log.Println("Error resolving package:", err)
+		// TODO: Don't pass the raw error through
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 	if pkg.Version != parsed.Version {
 		// If the version changed from what was requested, send a redirect
-		http.Redirect(w, r, unpkgURL(pkg.Name, pkg.Version, parsed.Path), http.StatusTemporaryRedirect)
+		u := unpkgURL(pkg.Name, pkg.Version, parsed.Path)
+		if r.URL.RawQuery != "" {
+			u += "?" + r.URL.RawQuery
+		}
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(h.redirectAge.Seconds())))
+		http.Redirect(w, r, u, http.StatusTemporaryRedirect)
 		return
 	}
 
-	// Determine path
-	var path string
-	switch {
+	if parsed.Path == "/bower.zip" {
+		h.serveBower(w, r, pkg)
+		return
+	}
+
+	query := r.URL.Query()
+	_, meta := query["meta"]
+	_, module := query["module"]
+	_, integrity := query["integrity"]
+	if meta && parsed.Path == "" {
+		parsed.Path = "/" // Metadata for a bare package lists the root
+	}
+
+	// Determine the entry point of bare package URLs. Subpaths are resolved
+	// once the package files are available.
+	path := parsed.Path
+	mainField := query.Get("main")
+	moduleMain, hasModuleMain := pkg.Field("module")
+	switch exported, err := h.resolveExport(pkg, parsed.Path); {
 	case parsed.Path != "":
-		path = parsed.Path
-	case pkg.Browser != "":
-		path = pkg.Browser
+	case mainField != "":
+		// Entry point overridden by query
+		var ok bool
+		if path, ok = pkg.Field(mainField); !ok {
+			http.Error(w, fmt.Sprintf("field %q not found in package.json", mainField), http.StatusNotFound)
+			return
+		}
+	case err == nil:
+		path = exported
+	case h.strictExports && len(pkg.Exports) > 0:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case module && hasModuleMain:
+		path = moduleMain
+	case pkg.Browser.Main != "":
+		path = pkg.Browser.Main
 	case pkg.Main != "":
 		path = pkg.Main
 	default:
@@ -131,32 +285,292 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	pkgDir := filepath.Join(h.cacheDir, pkg.Name+"-"+pkg.Version)
-	fullpath := filepath.Join(pkgDir, path)
+	pkgDir := filepath.Join(h.cacheDir, pkgDirName(pkg.Name, pkg.Version))
+
+	// Prevent the package being evicted while the request uses it
+	release := h.disk.acquire(pkgDirName(pkg.Name, pkg.Version))
+	defer release()
 
-	// Try to send from file cache
-	if tryFileCache(w, r, fullpath) {
-		log.Printf("Found %q in file cache\n", fullpath)
-		// Success, we're done
+	// Download the package if it isn't in the file cache
+	if !h.isDownloaded(pkg, pkgDir) {
+		log.Printf("%q not found in file cache, downloading...\n", pkgDir)
+		if err := h.download(pkg, pkgDir); err != nil {
+			log.Printf("Error downloading %q: %v\n", pkg.URL, err)
+			// TODO: Don't pass the raw error through
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%q %s download complete\n", pkg.Name, pkg.Version)
+	}
+
+	fsys, closeFS, err := h.packageFS(pkgDir)
+	if err != nil {
+		log.Printf("Error opening %q: %v\n", pkgDir, err)
+		http.Error(w, "error opening package", http.StatusInternalServerError)
 		return
 	}
+	defer closeFS()
 
-	// Need to download the package
-	log.Printf("%q not found in file cache, downloading...\n", fullpath)
+	if parsed.Path != "" {
+		if path, err = h.resolveSubpath(pkg, fsys, parsed.Path); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+
+	// Apply file replacements from the package.json browser field
+	replaced, ok := pkg.Browser.Resolve(path)
+	if !ok {
+		http.Error(w, "file excluded from browser by package.json", http.StatusNotFound)
+		return
+	}
+	browserReplaced := replaced != path
+	path = replaced
+
+	// Resolve extensionless paths and directories as Node does
+	if !meta && !strings.HasSuffix(path, "/") {
+		if resolved, ok := resolveFile(fsys, path); ok {
+			path = resolved
+		}
+	}
+
+	if parsed.Path != "" && !browserReplaced && path != parsed.Path {
+		// Redirect so caches see the canonical file URL
+		u := unpkgURL(pkg.Name, pkg.Version, path)
+		if r.URL.RawQuery != "" {
+			u += "?" + r.URL.RawQuery
+		}
+		w.Header().Set("Cache-Control", immutable)
+		http.Redirect(w, r, u, http.StatusMovedPermanently)
+		return
+	}
+
+	switch {
+	case meta:
+		h.serveMeta(w, r, pkg, fsys, path)
+	case integrity:
+		h.serveIntegrity(w, r, pkg, fsys, path)
+	case module:
+		h.serveModule(w, r, pkg, fsys, path)
+	default:
+		h.serveFile(w, r, pkg, fsys, path)
+	}
+}
+
+// download retrieves pkg into pkgDir from the shared cache, or downloads it
+// from the registry in the configured format if it isn't cached there, then
+// hashes its files. Downloaded packages are added to the shared cache in the
+// background. With -packageFormat shared, pkgDir isn't written, see
+// downloadShared.
+func (h *handler) download(pkg *npm.Package, pkgDir string) error {
+	name := pkgDirName(pkg.Name, pkg.Version)
 
 	// Use singleflight to supress downloading the same package concurrently
-	_, err, _ = h.sf.Do(pkg.URL, func() (interface{}, error) {
-		return nil, npm.Download(pkg.URL, pkg.Hash, pkgDir)
+	_, err, _ := h.sf.Do(pkg.URL, func() (interface{}, error) {
+		if h.serveShared {
+			return nil, h.downloadShared(pkg, name)
+		}
+
+		stored := false
+		if h.shared != nil {
+			err := storage.Get(h.shared, name, pkgDir)
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("Error retrieving %q from shared cache: %v\n", name, err)
+			}
+			stored = err == nil
+		}
+		if !stored {
+			download := h.registry.Download
+			if h.archive {
+				download = h.registry.DownloadArchive
+			}
+			if err := download(pkg, pkgDir); err != nil {
+				return nil, err
+			}
+		}
+		size := dirSize(pkgDir)
+		if !extract.IsArchive(pkgDir) {
+			// Store files shared with other versions once
+			refs, err := dedupe(pkgDir, filepath.Join(h.cacheDir, blobsDirName))
+			if err != nil {
+				log.Printf("Error deduplicating files of %q: %v\n", name, err)
+			}
+			h.disk.addBlobs(name, refs)
+			size -= refsSize(refs)
+		}
+		h.disk.grow(name, size)
+
+		fsys, closeFS, err := h.packageFS(pkgDir)
+		if err == nil {
+			_, err = h.packageIntegrity(pkg, fsys)
+			closeFS()
+		}
+		if err != nil {
+			// Hashes are computed again when first requested
+			log.Printf("Error hashing files of %q %s: %v\n", pkg.Name, pkg.Version, err)
+		}
+
+		if h.shared != nil && !stored {
+			// Prevent eviction until uploaded
+			release := h.disk.acquire(name)
+			go func() {
+				defer release()
+				if err := h.shared.Put(name, pkgDir); err != nil {
+					log.Printf("Error storing %q: %v\n", name, err)
+				}
+			}()
+		}
+		return nil, nil
 	})
+	return err
+}
+
+// isDownloaded reports whether pkg has been downloaded to pkgDir, or with
+// -packageFormat shared, whether its integrity has been retrieved from the
+// shared cache
+func (h *handler) isDownloaded(pkg *npm.Package, pkgDir string) bool {
+	p := pkgDir
+	if h.serveShared {
+		p = filepath.Join(h.generatedDir(pkg), integrityFile)
+	}
+	_, err := os.Stat(p)
+	return !os.IsNotExist(err)
+}
+
+// downloadShared adds pkg to the shared cache from the registry if it isn't
+// stored there yet, then writes the integrity stored with it to the
+// generated directory. Its files aren't kept in the cache directory, they
+// are served from the shared cache.
+func (h *handler) downloadShared(pkg *npm.Package, name string) error {
+	hashes, err := h.shared.Integrity(name)
+	if os.IsNotExist(err) {
+		if err := h.downloadToShared(pkg, name); err != nil {
+			return err
+		}
+		hashes, err = h.shared.Integrity(name)
+	}
 	if err != nil {
-		log.Printf("Error downloading %q: %v\n", pkg.URL, err)
-		// TODO: Don't pass the raw error through
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
+	}
+
+	// Stored paths are relative to the package root, unlike those hashed by
+	// buildIntegrity
+	rooted := make(map[string]string, len(hashes))
+	for p, sri := range hashes {
+		rooted[path.Clean("/"+p)] = sri
+	}
+	b, err := json.Marshal(rooted)
+	if err != nil {
+		return err
+	}
+	dest := filepath.Join(h.generatedDir(pkg), integrityFile)
+	if err := writeFileAtomic(dest, b); err != nil {
+		return err
+	}
+	h.generated(pkg, dest)
+	return nil
+}
+
+// downloadToShared downloads pkg from the registry to a temporary directory
+// and stores it in the shared cache as name
+func (h *handler) downloadToShared(pkg *npm.Package, name string) error {
+	tmp, err := ioutil.TempDir("", "unpkg")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	dir := filepath.Join(tmp, name)
+	if err := h.registry.Download(pkg, dir); err != nil {
+		return err
+	}
+	return h.shared.Put(name, dir)
+}
+
+// packageFS returns the files of the package in pkgDir, and a function to
+// call once done with them. Packages may be archives regardless of
+// -packageFormat, as they can be retrieved from the shared cache of servers
+// using the other format. With -packageFormat shared, the files are read
+// from the shared cache instead.
+//
+// Archives are kept open until their package is evicted. Without
+// -cacheSize packages are never evicted, so archives are opened for each
+// caller and closed by the returned function instead.
+func (h *handler) packageFS(pkgDir string) (fsys fs.FS, closeFS func(), err error) {
+	noop := func() {}
+	if h.serveShared {
+		return storage.FS(h.shared, filepath.Base(pkgDir)), noop, nil
+	}
+	if h.disk == nil {
+		if !extract.IsArchive(pkgDir) {
+			return os.DirFS(pkgDir), noop, nil
+		}
+		a, err := extract.OpenArchive(pkgDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		return a, func() { a.Close() }, nil
+	}
+
+	h.archivesMu.Lock()
+	defer h.archivesMu.Unlock()
+
+	if a, ok := h.archives[pkgDir]; ok {
+		return a, noop, nil
+	}
+	if !extract.IsArchive(pkgDir) {
+		return os.DirFS(pkgDir), noop, nil
 	}
-	log.Printf("%q %s download complete\n", pkg.Name, pkg.Version)
 
-	serveFile(w, r, fullpath)
+	a, err := extract.OpenArchive(pkgDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if h.archives == nil {
+		h.archives = make(map[string]*extract.Archive)
+	}
+	h.archives[pkgDir] = a
+	return a, noop, nil
+}
+
+// resolveExport resolves the request path against the package.json
+// exports field. Bare package requests resolve the "." export.
+func (h *handler) resolveExport(pkg *npm.Package, urlPath string) (string, error) {
+	if urlPath == "/" {
+		return "", npm.ErrNotExported // Directory listing
+	}
+	return pkg.ResolveExport("."+urlPath, h.conditions)
+}
+
+// resolveSubpath resolves the request path p, a subpath of pkg, to the path
+// within the package files fsys to serve.
+//
+// Without -strictExports, files and directories at p take precedence over
+// the exports field, which only resolves subpaths that don't exist. With
+// it, p must be exported, unless it's a file that is an export target, so
+// that exported subpaths can redirect to their files.
+func (h *handler) resolveSubpath(pkg *npm.Package, fsys fs.FS, p string) (string, error) {
+	exported, err := h.resolveExport(pkg, p)
+	literal, isLiteral := resolveFile(fsys, p)
+	isLiteral = isLiteral || isDir(fsys, p)
+
+	if !h.strictExports || len(pkg.Exports) == 0 || p == "/" {
+		if !isLiteral && err == nil && isFile(fsys, exported) {
+			return exported, nil
+		}
+		return p, nil
+	}
+
+	if isLiteral && pkg.IsExportTarget(literal, h.conditions) {
+		return p, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !isFile(fsys, exported) {
+		return "", fmt.Errorf("exported file %s not found", exported)
+	}
+	return exported, nil
 }
 
 // fileTypes defines custom content types for file extensions
@@ -166,22 +580,70 @@ var fileTypes = map[string]string{
 	".md": "text/x-markdown",
 }
 
-// serveFile sends the file or lists the directory at p
-func serveFile(w http.ResponseWriter, r *http.Request, p string) {
+// immutable is the Cache-Control header of responses for exact package
+// versions, which never change once published
+const immutable = "public, max-age=31536000, immutable"
+
+// serveFile sends the file or lists the directory at p within the package
+// files fsys. Files include their Subresource Integrity hash in the
+// Integrity header, which is also used as the ETag.
+func (h *handler) serveFile(w http.ResponseWriter, r *http.Request, pkg *npm.Package, fsys fs.FS, p string) {
 	if ct, ok := fileTypes[strings.ToLower(path.Ext(p))]; ok {
 		w.Header().Set("Content-Type", ct)
 	}
-	http.ServeFile(w, r, p)
+	w.Header().Set("Cache-Control", immutable)
+	if sri, ok := h.fileIntegrity(pkg, fsys, p); ok {
+		w.Header().Set(integrityHeader, sri)
+		w.Header().Set("ETag", `"`+sri+`"`)
+	}
+
+	variant := filepath.Join(h.generatedDir(pkg), compressedDirName, filepath.FromSlash(path.Clean("/"+p)))
+	h.serveContent(w, r, pkg, p, fsys, fsPath(p), variant)
 }
 
-// tryFileCache will send the file at p if the file exists, returns true if successful
-func tryFileCache(w http.ResponseWriter, r *http.Request, p string) bool {
-	if _, err := os.Stat(p); os.IsNotExist(err) {
-		return false
+// generatedDirName is the directory within the cache directory holding
+// files generated from packages. Package directories always contain a "-"
+// so it cannot conflict with them.
+const generatedDirName = "_generated"
+
+// generatedDir returns the directory holding files generated from pkg,
+// such as Bower bundles
+func (h *handler) generatedDir(pkg *npm.Package) string {
+	return filepath.Join(h.cacheDir, generatedDirName, pkgDirName(pkg.Name, pkg.Version))
+}
+
+// generated records the size of the file at p, generated from pkg, against
+// the cache size quota
+func (h *handler) generated(pkg *npm.Package, p string) {
+	if fi, err := os.Stat(p); err == nil {
+		h.disk.grow(pkgDirName(pkg.Name, pkg.Version), fi.Size())
 	}
+}
+
+// evicted forgets state held for the package directory name after it's
+// removed from the cache directory
+func (h *handler) evicted(name string) {
+	pkgDir := filepath.Join(h.cacheDir, name)
+
+	h.integrityMu.Lock()
+	delete(h.integrity, pkgDir)
+	h.integrityMu.Unlock()
 
-	serveFile(w, r, p)
-	return true
+	h.archivesMu.Lock()
+	if a, ok := h.archives[pkgDir]; ok {
+		a.Close()
+		delete(h.archives, pkgDir)
+	}
+	h.archivesMu.Unlock()
+}
+
+// pkgDirName returns the name of the directory a package version is
+// extracted to within the cache directory.
+//
+// The slash in scoped package names is escaped so that every package
+// version is a single directory directly under the cache directory.
+func pkgDirName(name, version string) string {
+	return strings.Replace(name, "/", "%2f", 1) + "-" + version
 }
 
 // unpkgURL returns the relative URL for this package for an unpkg server.
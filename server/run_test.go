@@ -0,0 +1,265 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vcabbage/go-unpkg/extract"
+	"github.com/vcabbage/go-unpkg/npm"
+	"github.com/vcabbage/go-unpkg/storage"
+)
+
+// testArchive writes a package archived with -packageFormat archive into
+// the cache directory dir
+func testArchive(t *testing.T, dir string) (*npm.Package, string) {
+	files := map[string]string{
+		"package/package.json": `{"name":"pkg","main":"lib/index.js"}`,
+		"package/lib/index.js": "alert('Hello, World!');",
+		"package/README.md":    strings.Repeat("# pkg\n", 100),
+	}
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, content := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gw.Close()
+
+	pkg := &npm.Package{Name: "pkg", Version: "1.0.0"}
+	pkgDir := filepath.Join(dir, pkgDirName(pkg.Name, pkg.Version))
+	if err := extract.TGZArchive(&buf, pkgDir); err != nil {
+		t.Fatal(err)
+	}
+	return pkg, pkgDir
+}
+
+func TestPackageFSArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pkg, pkgDir := testArchive(t, dir)
+
+	disk, err := newDiskCache(dir, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &handler{cacheDir: dir, disk: disk}
+	fsys, closeFS, err := h.packageFS(pkgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFS()
+	if _, ok := fsys.(*extract.Archive); !ok {
+		t.Fatalf("packageFS() = %T, want *extract.Archive", fsys)
+	}
+	if resolved, ok := resolveFile(fsys, "/lib/index"); !ok || resolved != "/lib/index.js" {
+		t.Errorf("resolveFile() = %q, %t, want /lib/index.js", resolved, ok)
+	}
+
+	serve := func(p string, header http.Header) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/pkg@1.0.0"+p, nil)
+		if header != nil {
+			r.Header = header
+		}
+		h.serveFile(w, r, pkg, fsys, p)
+		return w
+	}
+
+	w := serve("/lib/index.js", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "alert('Hello, World!');" {
+		t.Errorf("file response = %d %q", w.Code, w.Body.String())
+	}
+	if got, want := w.Header().Get(integrityHeader), "sha384-Bg9twQOyM+pxvxdZFXOxQ8mzISbQpouZ9Miui8VIeVuTR6/BlDEK6CCrnZmaL6iB"; got != want {
+		t.Errorf("%s header = %q, want %q", integrityHeader, got, want)
+	}
+
+	w = serve("/README.md", http.Header{"Range": {"bytes=2-4"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "pkg" {
+		t.Errorf("range response = %d %q, want 206 \"pkg\"", w.Code, w.Body.String())
+	}
+
+	w = serve("/README.md", http.Header{"Accept-Encoding": {"gzip"}})
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("Content-Encoding = %q, want gzip", got)
+	}
+
+	w = serve("/lib/", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "index.js") {
+		t.Errorf("directory listing = %d %q", w.Code, w.Body.String())
+	}
+
+	// Archives are closed once evicted
+	h.evicted(filepath.Base(pkgDir))
+	if _, ok := h.archives[pkgDir]; ok {
+		t.Error("archive still open after eviction")
+	}
+	if _, err := fs.ReadFile(fsys, "lib/index.js"); err == nil {
+		t.Error("read from archive after eviction succeeded")
+	}
+}
+
+// Without -cacheSize packages are never evicted, so archives must be
+// closed after each use
+func TestPackageFSArchiveNoCacheSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, pkgDir := testArchive(t, dir)
+
+	h := &handler{cacheDir: dir}
+	fsys, closeFS, err := h.packageFS(pkgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := fs.ReadFile(fsys, "lib/index.js"); string(b) != "alert('Hello, World!');" || err != nil {
+		t.Errorf("lib/index.js = %q, %v", b, err)
+	}
+
+	closeFS()
+	if len(h.archives) != 0 {
+		t.Errorf("%d archives kept open", len(h.archives))
+	}
+	if _, err := fs.ReadFile(fsys, "lib/index.js"); err == nil {
+		t.Error("read from archive after close succeeded")
+	}
+}
+
+func TestPackageFSShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pkg := &npm.Package{Name: "pkg", Version: "1.0.0"}
+	src := filepath.Join(dir, "src")
+	writeFiles(t, src, map[string]string{"package.json": "{}", "lib/index.js": "alert('Hello, World!');"})
+	shared := &storage.Local{Dir: filepath.Join(dir, "shared")}
+	if err := shared.Put(pkgDirName(pkg.Name, pkg.Version), src); err != nil {
+		t.Fatal(err)
+	}
+
+	h := &handler{cacheDir: filepath.Join(dir, "cache"), shared: shared, serveShared: true}
+	pkgDir := filepath.Join(h.cacheDir, pkgDirName(pkg.Name, pkg.Version))
+	if h.isDownloaded(pkg, pkgDir) {
+		t.Fatal("package downloaded before download")
+	}
+	if err := h.download(pkg, pkgDir); err != nil {
+		t.Fatal(err)
+	}
+	if !h.isDownloaded(pkg, pkgDir) {
+		t.Error("package not downloaded after download")
+	}
+	if _, err := os.Stat(pkgDir); !os.IsNotExist(err) {
+		t.Errorf("package files kept in the cache directory: %v", err)
+	}
+
+	fsys, closeFS, err := h.packageFS(pkgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFS()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/pkg@1.0.0/lib/index.js", nil)
+	r.Header.Set("Range", "bytes=0-4")
+	h.serveFile(w, r, pkg, fsys, "/lib/index.js")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "alert" {
+		t.Errorf("range response = %d %q, want %d %q", w.Code, w.Body.String(), http.StatusPartialContent, "alert")
+	}
+	// echo -n "alert('Hello, World!');" | openssl dgst -sha384 -binary | base64
+	const want = "sha384-Bg9twQOyM+pxvxdZFXOxQ8mzISbQpouZ9Miui8VIeVuTR6/BlDEK6CCrnZmaL6iB"
+	if got := w.Header().Get(integrityHeader); got != want {
+		t.Errorf("%s header = %q, want %q", integrityHeader, got, want)
+	}
+}
+
+var exportsTests = map[string]struct {
+	path   string
+	strict bool
+	status int
+	want   string // Location of redirects, otherwise the body
+}{
+	"bare":                            {path: "", status: http.StatusOK, want: "index"},
+	"bare,strict":                     {path: "", strict: true, status: http.StatusOK, want: "index"},
+	"exported":                        {path: "/feature", status: http.StatusMovedPermanently, want: "/pkg@1.0.0/dist/feature.js"},
+	"exported,strict":                 {path: "/feature", strict: true, status: http.StatusMovedPermanently, want: "/pkg@1.0.0/dist/feature.js"},
+	"pattern":                         {path: "/foo", status: http.StatusMovedPermanently, want: "/pkg@1.0.0/dist/foo.js"},
+	"literal matching pattern":        {path: "/dist/foo.js", status: http.StatusOK, want: "foo"},
+	"literal matching pattern,strict": {path: "/dist/foo.js", strict: true, status: http.StatusOK, want: "foo"},
+	"not exported":                    {path: "/internal/x.js", status: http.StatusOK, want: "internal"},
+	"not exported,strict":             {path: "/internal/x.js", strict: true, status: http.StatusNotFound},
+	"not export target,strict":        {path: "/README.md", strict: true, status: http.StatusNotFound},
+	"missing":                         {path: "/missing.js", status: http.StatusNotFound},
+}
+
+func TestServeExports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pkg := &npm.Package{
+		Name:    "pkg",
+		Version: "1.0.0",
+		Exports: json.RawMessage(`{
+			".": "./dist/index.js",
+			"./feature": "./dist/feature.js",
+			"./internal/*": null,
+			"./*": "./dist/*.js"
+		}`),
+	}
+	writeFiles(t, filepath.Join(dir, pkgDirName(pkg.Name, pkg.Version)), map[string]string{
+		"dist/index.js":   "index",
+		"dist/feature.js": "feature",
+		"dist/foo.js":     "foo",
+		"internal/x.js":   "internal",
+		"README.md":       "# pkg",
+	})
+
+	for label, tt := range exportsTests {
+		t.Run(label, func(t *testing.T) {
+			h := &handler{
+				c:             newCache(0, nil, nil),
+				cacheDir:      dir,
+				conditions:    npm.DefaultConditions,
+				strictExports: tt.strict,
+			}
+			h.c.addPackage(pkg)
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/pkg@1.0.0"+tt.path, nil))
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			switch tt.status {
+			case http.StatusMovedPermanently:
+				if got := w.Header().Get("Location"); got != tt.want {
+					t.Errorf("Location = %q, want %q", got, tt.want)
+				}
+			case http.StatusOK:
+				if got := w.Body.String(); got != tt.want {
+					t.Errorf("body = %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
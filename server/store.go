@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/vcabbage/go-unpkg/npm"
+)
+
+// packageStoreFile is the file in the cache directory persisting resolved
+// packages across restarts
+const packageStoreFile = "packages.jsonl"
+
+// packageStoreSchema is the version of the package store format. Increment
+// it and add a migration when npm.Package changes in a way that previous
+// records can't be decoded as.
+const packageStoreSchema = 1
+
+// packageStoreMigrations convert records from the schema version they're
+// keyed by to the next version
+var packageStoreMigrations = map[int]func(record json.RawMessage) (json.RawMessage, error){}
+
+// packageStoreHeader is the first line of the package store
+type packageStoreHeader struct {
+	Schema int `json:"schema"`
+}
+
+// packageStore persists resolved packages to a file of JSON lines,
+// starting with a header holding the schema version. Records are only
+// appended, as resolved packages never change.
+type packageStore struct {
+	mu sync.Mutex
+	f  *os.File
+
+	// packages read when the store was opened
+	packages []npm.Package
+}
+
+// openPackageStore reads the package store at p, creating it if it doesn't
+// exist. Stores with an older schema are migrated, unreadable records are
+// dropped and stores with a newer schema are discarded.
+func openPackageStore(p string) (*packageStore, error) {
+	s := &packageStore{}
+
+	rewrite, err := s.read(p)
+	if err != nil {
+		return nil, err
+	}
+	if rewrite {
+		if err := s.rewrite(p); err != nil {
+			return nil, err
+		}
+	}
+
+	s.f, err = os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// read decodes the packages in the store at p, returning true if the file
+// must be rewritten in the current schema
+func (s *packageStore) read(p string) (rewrite bool, err error) {
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(nil, len(b)+1) // package.json can exceed the default limit
+	if !scanner.Scan() {
+		return true, nil // Empty
+	}
+
+	var header packageStoreHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Schema < 1 {
+		log.Printf("Discarding package store %q with invalid header\n", p)
+		return true, nil
+	}
+	if header.Schema > packageStoreSchema {
+		log.Printf("Discarding package store %q with newer schema %d\n", p, header.Schema)
+		return true, nil
+	}
+	rewrite = header.Schema != packageStoreSchema
+
+	for scanner.Scan() {
+		record, err := migratePackage(scanner.Bytes(), header.Schema)
+		if err != nil {
+			log.Printf("Dropping package store record: %v\n", err)
+			rewrite = true
+			continue
+		}
+
+		var pkg npm.Package
+		if err := json.Unmarshal(record, &pkg); err != nil || pkg.Name == "" || pkg.Version == "" {
+			// Likely partially written
+			log.Printf("Dropping invalid package store record: %v\n", err)
+			rewrite = true
+			continue
+		}
+		s.packages = append(s.packages, pkg)
+	}
+	return rewrite, scanner.Err()
+}
+
+// migratePackage converts record from schema to the current schema
+func migratePackage(record []byte, schema int) (json.RawMessage, error) {
+	migrated := json.RawMessage(append([]byte(nil), record...))
+	for ; schema < packageStoreSchema; schema++ {
+		migrate, ok := packageStoreMigrations[schema]
+		if !ok {
+			return nil, fmt.Errorf("no migration from schema %d", schema)
+		}
+
+		var err error
+		if migrated, err = migrate(migrated); err != nil {
+			return nil, err
+		}
+	}
+	return migrated, nil
+}
+
+// rewrite replaces the store at p with the packages read, in the current
+// schema
+func (s *packageStore) rewrite(p string) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	if err := enc.Encode(packageStoreHeader{Schema: packageStoreSchema}); err != nil {
+		return err
+	}
+	for i := range s.packages {
+		if err := enc.Encode(&s.packages[i]); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(p, buf.Bytes())
+}
+
+// add appends pkg to the store
+func (s *packageStore) add(pkg *npm.Package) error {
+	b, err := json.Marshal(pkg)
+	if err != nil {
+		return err
+	}
+
+	// Records are written with a single call so that they aren't interleaved
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.f.Write(append(b, '\n'))
+	return err
+}
+
+// Close closes the store file
+func (s *packageStore) Close() error {
+	return s.f.Close()
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vcabbage/go-unpkg/npm"
+)
+
+func TestPackageStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, packageStoreFile)
+
+	pkgs := []npm.Package{
+		{
+			Name:      "@test/pkg",
+			Version:   "1.0.0",
+			Hash:      "abc",
+			Integrity: "sha512-abc",
+			URL:       "https://registry.npmjs.org/@test/pkg/-/pkg-1.0.0.tgz",
+			Main:      "index.js",
+			Browser:   npm.Browser{Map: map[string]string{"/lib/node.js": "/lib/browser.js", "fs": ""}},
+			Exports:   json.RawMessage(`{".":"./index.js"}`),
+			Fields: map[string]json.RawMessage{
+				"name":    json.RawMessage(`"@test/pkg"`),
+				"version": json.RawMessage(`"1.0.0"`),
+			},
+		},
+		{Name: "react", Version: "15.6.2", Browser: npm.Browser{Main: "dist/react.js"}},
+	}
+
+	s, err := openPackageStore(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newCache(0, nil, s)
+	for i := range pkgs {
+		c.addPackage(&pkgs[i], "latest")
+	}
+	c.addPackage(&pkgs[0]) // Already stored
+	s.Close()
+
+	// Restart
+	s, err = openPackageStore(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.packages, pkgs) {
+		t.Errorf("loaded %+v, want %+v", s.packages, pkgs)
+	}
+	c = newCache(0, nil, s)
+	if got, err := c.getPackage("react", "15.6.2"); err != nil || got.Browser.Main != "dist/react.js" {
+		t.Errorf("getPackage() = %+v, %v", got, err)
+	}
+	if _, err := c.getPackage("react", "latest"); err == nil {
+		t.Error("unresolved versions shouldn't be persisted")
+	}
+	s.Close()
+
+	// Partially written records are dropped
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"Name":"torn","Ver`)
+	f.Close()
+
+	s, err = openPackageStore(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.add(&npm.Package{Name: "after", Version: "1.0.0"})
+	s.Close()
+
+	s, err = openPackageStore(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.packages) != 3 || s.packages[2].Name != "after" {
+		t.Errorf("loaded %+v after torn record, want 3 packages ending with after", s.packages)
+	}
+	s.Close()
+}
+
+func TestPackageStoreSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, packageStoreFile)
+
+	for label, header := range map[string]string{
+		"newer":   `{"schema":1000}`,
+		"invalid": `not json`,
+	} {
+		t.Run(label, func(t *testing.T) {
+			content := header + "\n" + `{"Name":"react","Version":"15.6.2"}` + "\n"
+			if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			s, err := openPackageStore(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Close()
+			if len(s.packages) != 0 {
+				t.Errorf("loaded %+v, want none", s.packages)
+			}
+
+			b, err := ioutil.ReadFile(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := `{"schema":1}`; strings.TrimSpace(string(b)) != want {
+				t.Errorf("store = %q, want %q", b, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FS returns the files of pkg in s as a read-only file system. Files are
+// read with Open as they're needed, so seeking in them, such as for range
+// requests, doesn't read the skipped content. Directories are implied by
+// the paths of the files, which are listed the first time one is opened.
+// It is safe for concurrent use.
+func FS(s Storage, pkg string) fs.FS {
+	return &storageFS{s: s, pkg: pkg}
+}
+
+// storageFS is the file system returned by FS
+type storageFS struct {
+	s   Storage
+	pkg string
+
+	listOnce sync.Once
+	files    []FileInfo
+	listErr  error
+}
+
+// Open opens the file or directory name
+func (fsys *storageFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name != "." {
+		fi, err := fsys.s.Stat(fsys.pkg, name)
+		if err == nil {
+			f, err := fsys.s.Open(fsys.pkg, name)
+			if err != nil {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+			}
+			return &storageFile{File: f, info: fileInfo{fi}}, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+
+	children, err := fsys.readDir(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &storageDir{info: dirInfo{name}, children: children}, nil
+}
+
+// readDir returns the entries of the directory name, or ErrNotExist if no
+// files are within it
+func (fsys *storageFS) readDir(name string) ([]fs.DirEntry, error) {
+	fsys.listOnce.Do(func() {
+		fsys.files, fsys.listErr = fsys.s.List(fsys.pkg)
+	})
+	if fsys.listErr != nil {
+		return nil, fsys.listErr
+	}
+
+	prefix := name + "/"
+	if name == "." {
+		prefix = ""
+	}
+	var children []fs.DirEntry
+	dirs := make(map[string]bool)
+	for _, fi := range fsys.files {
+		if !strings.HasPrefix(fi.Path, prefix) {
+			continue
+		}
+		rel := fi.Path[len(prefix):]
+		if i := strings.IndexByte(rel, '/'); i >= 0 {
+			if dir := prefix + rel[:i]; !dirs[dir] {
+				dirs[dir] = true
+				children = append(children, fs.FileInfoToDirEntry(dirInfo{dir}))
+			}
+			continue
+		}
+		children = append(children, fs.FileInfoToDirEntry(fileInfo{fi}))
+	}
+	if len(children) == 0 && name != "." {
+		return nil, ErrNotExist
+	}
+
+	sort.Slice(children, func(i, j int) bool { return children[i].Name() < children[j].Name() })
+	return children, nil
+}
+
+// fileInfo describes a stored file as an fs.FileInfo
+type fileInfo struct {
+	fi FileInfo
+}
+
+func (i fileInfo) Name() string       { return path.Base(i.fi.Path) }
+func (i fileInfo) Size() int64        { return i.fi.Size }
+func (i fileInfo) Mode() fs.FileMode  { return 0444 }
+func (i fileInfo) ModTime() time.Time { return i.fi.ModTime }
+func (i fileInfo) IsDir() bool        { return false }
+func (i fileInfo) Sys() interface{}   { return nil }
+
+// dirInfo describes a directory implied by the paths of stored files
+type dirInfo struct {
+	name string
+}
+
+func (i dirInfo) Name() string       { return path.Base(i.name) }
+func (i dirInfo) Size() int64        { return 0 }
+func (i dirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (i dirInfo) ModTime() time.Time { return time.Time{} }
+func (i dirInfo) IsDir() bool        { return true }
+func (i dirInfo) Sys() interface{}   { return nil }
+
+// storageFile is a file opened from a storageFS
+type storageFile struct {
+	File
+	info fileInfo
+}
+
+func (f *storageFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+// storageDir is a directory opened from a storageFS
+type storageDir struct {
+	info     dirInfo
+	children []fs.DirEntry
+	offset   int
+}
+
+func (d *storageDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *storageDir) Close() error               { return nil }
+
+func (d *storageDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir returns the next n entries of d, or all remaining if n <= 0
+func (d *storageDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.children[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.children)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.offset += n
+	return rest[:n], nil
+}
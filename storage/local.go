@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// integrityDirName is the directory within Local.Dir holding the integrity
+// of each completely stored package. Package names can't start with a ".",
+// so it cannot conflict with them.
+const integrityDirName = ".integrity"
+
+// Local stores packages in a directory, which may be shared over the
+// network. Each package is a subdirectory, with its integrity stored in
+// integrityDirName once it's complete.
+type Local struct {
+	Dir string
+}
+
+func (l *Local) path(pkg, p string) (string, error) {
+	if err := checkPackage(pkg); err != nil {
+		return "", err
+	}
+	p, err := cleanPath(p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(l.Dir, pkg, filepath.FromSlash(p)), nil
+}
+
+// Stat returns information about the file p in pkg
+func (l *Local) Stat(pkg, p string) (FileInfo, error) {
+	fullpath, err := l.path(pkg, p)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	fi, err := os.Stat(fullpath)
+	if os.IsNotExist(err) || err == nil && !fi.Mode().IsRegular() {
+		return FileInfo{}, ErrNotExist
+	}
+	if err != nil {
+		return FileInfo{}, err
+	}
+	p, _ = cleanPath(p)
+	return FileInfo{Path: p, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// Open opens the file p in pkg
+func (l *Local) Open(pkg, p string) (File, error) {
+	if _, err := l.Stat(pkg, p); err != nil {
+		return nil, err
+	}
+	fullpath, _ := l.path(pkg, p)
+	return os.Open(fullpath)
+}
+
+// List returns all files in pkg, if its integrity is stored
+func (l *Local) List(pkg string) ([]FileInfo, error) {
+	if _, err := l.Integrity(pkg); err != nil {
+		return nil, err
+	}
+
+	files, err := walkFiles(filepath.Join(l.Dir, pkg))
+	if os.IsNotExist(err) || err == nil && len(files) == 0 {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]FileInfo, 0, len(files))
+	for _, f := range files {
+		fi, err := os.Stat(f.fullpath)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, FileInfo{Path: f.path, Size: fi.Size(), ModTime: fi.ModTime()})
+	}
+	return infos, nil
+}
+
+// Integrity returns the integrity of the files in pkg
+func (l *Local) Integrity(pkg string) (map[string]string, error) {
+	if err := checkPackage(pkg); err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(l.Dir, integrityDirName, pkg))
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(b)
+}
+
+// Put copies the files in dir into a temporary directory, then moves it
+// into place and writes its integrity
+func (l *Local) Put(pkg, dir string) error {
+	if err := checkPackage(pkg); err != nil {
+		return err
+	}
+
+	files, err := walkFiles(dir)
+	if err != nil {
+		return err
+	}
+	integrity, err := manifest(files)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(l.Dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, f := range files {
+		if err := copyFile(f.fullpath, filepath.Join(tmp, filepath.FromSlash(f.path))); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return err
+	}
+
+	dest := filepath.Join(l.Dir, pkg)
+	if err := l.Delete(pkg); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		return err
+	}
+	return l.writeIntegrity(pkg, integrity)
+}
+
+// writeIntegrity writes the integrity of pkg to a temporary file, then
+// moves it into place, so that it's never partially written
+func (l *Local) writeIntegrity(pkg string, integrity []byte) error {
+	integrityDir := filepath.Join(l.Dir, integrityDirName)
+	if err := os.MkdirAll(integrityDir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(integrityDir, tempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(integrity); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(integrityDir, pkg))
+}
+
+// Delete removes the integrity of pkg, so that it's no longer listed, then
+// moves pkg out of the way and removes it
+func (l *Local) Delete(pkg string) error {
+	if err := checkPackage(pkg); err != nil {
+		return err
+	}
+
+	err := os.Remove(filepath.Join(l.Dir, integrityDirName, pkg))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	tmp, err := ioutil.TempDir(l.Dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	err = os.Rename(filepath.Join(l.Dir, pkg), filepath.Join(tmp, pkg))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// copyFile copies the file at src to dest, creating its directory
+func copyFile(src, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
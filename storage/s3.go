@@ -0,0 +1,465 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// emptySHA256 is the hex SHA-256 of an empty payload
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3 stores packages in an S3 compatible bucket, such as AWS S3 or MinIO.
+// Files are objects keyed by the prefix, package and path.
+//
+// Once all files of a package are stored, a marker object holding their
+// integrity is stored alongside them. Packages without one aren't listed.
+type S3 struct {
+	// Endpoint is the base URL of the service, eg. "https://s3.amazonaws.com".
+	// Buckets are addressed by path.
+	Endpoint string
+	Bucket   string
+	Prefix   string
+	Region   string
+
+	// Requests are signed with AWS Signature Version 4 if set
+	AccessKey string
+	SecretKey string
+
+	// Client is used for requests, http.DefaultClient if nil
+	Client *http.Client
+}
+
+func (s *S3) key(pkg, p string) (string, error) {
+	if err := checkPackage(pkg); err != nil {
+		return "", err
+	}
+	p, err := cleanPath(p)
+	if err != nil {
+		return "", err
+	}
+	return s.packagePrefix(pkg) + p, nil
+}
+
+// packagePrefix returns the prefix of the keys of files in pkg
+func (s *S3) packagePrefix(pkg string) string {
+	return s.completeKey(pkg) + "/"
+}
+
+// completeKey returns the key of the marker object holding the integrity
+// of pkg, stored once pkg is completely stored. It can't conflict with
+// files, which are all within the package prefix, or other packages, whose
+// prefixes all end in "/".
+func (s *S3) completeKey(pkg string) string {
+	prefix := s.Prefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix + pkg
+}
+
+// Stat returns information about the file p in pkg
+func (s *S3) Stat(pkg, p string) (FileInfo, error) {
+	key, err := s.key(pkg, p)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	resp, err := s.do("HEAD", key, nil, nil, nil)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp.Body.Close()
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return FileInfo{Path: strings.TrimPrefix(key, s.packagePrefix(pkg)), Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+// Open opens the file p in pkg. Reads are made with range requests, so
+// seeking doesn't download the skipped content.
+func (s *S3) Open(pkg, p string) (File, error) {
+	fi, err := s.Stat(pkg, p)
+	if err != nil {
+		return nil, err
+	}
+	key, _ := s.key(pkg, p)
+	return &s3File{s: s, key: key, size: fi.Size}, nil
+}
+
+// List returns all files in pkg, if its marker object exists
+func (s *S3) List(pkg string) ([]FileInfo, error) {
+	if _, err := s.Integrity(pkg); err != nil {
+		return nil, err
+	}
+	return s.list(pkg)
+}
+
+// Integrity returns the integrity of the files in pkg, read from its
+// marker object
+func (s *S3) Integrity(pkg string) (map[string]string, error) {
+	if err := checkPackage(pkg); err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do("GET", s.completeKey(pkg), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(b)
+}
+
+// list returns all objects with the prefix of pkg
+func (s *S3) list(pkg string) ([]FileInfo, error) {
+	prefix := s.packagePrefix(pkg)
+
+	var (
+		infos []FileInfo
+		token string
+	)
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range result.Contents {
+			infos = append(infos, FileInfo{
+				Path:    strings.TrimPrefix(c.Key, prefix),
+				Size:    c.Size,
+				ModTime: c.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	if len(infos) == 0 {
+		return nil, ErrNotExist
+	}
+	return infos, nil
+}
+
+// Put uploads the files in dir, then the marker object holding their
+// integrity. Objects left from a previous version of pkg that aren't in dir
+// are not removed.
+func (s *S3) Put(pkg, dir string) error {
+	if err := checkPackage(pkg); err != nil {
+		return err
+	}
+
+	files, err := walkFiles(dir)
+	if err != nil {
+		return err
+	}
+	integrity, err := manifest(files)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		body, err := ioutil.ReadFile(f.fullpath)
+		if err != nil {
+			return err
+		}
+		key, err := s.key(pkg, f.path)
+		if err != nil {
+			return err
+		}
+		resp, err := s.do("PUT", key, nil, nil, body)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := s.do("PUT", s.completeKey(pkg), nil, nil, integrity)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Delete removes the marker object of pkg, so that it's no longer listed,
+// then every file in it
+func (s *S3) Delete(pkg string) error {
+	if err := checkPackage(pkg); err != nil {
+		return err
+	}
+
+	resp, err := s.do("DELETE", s.completeKey(pkg), nil, nil, nil)
+	if err != nil && err != ErrNotExist {
+		return err
+	}
+	if err == nil {
+		resp.Body.Close()
+	}
+
+	infos, err := s.list(pkg)
+	if err == ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, fi := range infos {
+		resp, err := s.do("DELETE", s.packagePrefix(pkg)+fi.Path, nil, nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// do sends a signed request for the object key, or the bucket if key is
+// empty. Responses other than 2xx are returned as errors, with 404 as
+// ErrNotExist.
+func (s *S3) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := s.Endpoint + "/" + uriEncode(s.Bucket, false)
+	if key != "" {
+		u += "/" + uriEncode(key, false)
+	}
+	if len(query) > 0 {
+		u += "?" + canonicalQuery(query)
+	}
+
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		req.Body, req.ContentLength = nil, 0
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	payloadHash := emptySHA256
+	if body != nil {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	s.sign(req, payloadHash, time.Now())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotExist
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		var s3Err struct{ Code, Message string }
+		if xml.Unmarshal(b, &s3Err) == nil && s3Err.Code != "" {
+			return nil, fmt.Errorf("storage: %s %s: %s: %s", method, key, s3Err.Code, s3Err.Message)
+		}
+		return nil, fmt.Errorf("storage: %s %s: %s", method, key, resp.Status)
+	}
+	return resp, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req,
+// signing all headers set on it. Requests aren't signed without
+// credentials.
+func (s *S3) sign(req *http.Request, payloadHash string, t time.Time) {
+	if s.AccessKey == "" {
+		return
+	}
+
+	amzDate := t.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + strings.Join(strings.Fields(headers[k]), " ") + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes query sorted by key, as required for signing
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent encodes every byte of s except unreserved characters,
+// and slashes unless encodeSlash is true
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~',
+			c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3File reads an object with range requests
+type s3File struct {
+	s    *S3
+	key  string
+	size int64
+
+	offset int64
+	body   io.ReadCloser // reading from offset, nil until read
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.offset >= f.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		header := http.Header{"Range": {"bytes=" + strconv.FormatInt(f.offset, 10) + "-"}}
+		resp, err := f.s.do("GET", f.key, nil, header, nil)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent && f.offset > 0 {
+			resp.Body.Close()
+			return 0, errors.New("storage: range requests not supported")
+		}
+		f.body = resp.Body
+	}
+
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	if err == io.EOF && f.offset < f.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, errors.New("storage: negative offset")
+	}
+
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *s3File) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
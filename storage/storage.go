@@ -0,0 +1,286 @@
+// Package storage is a second-level cache of package files shared between
+// servers. Servers either serve packages from their own cache directory,
+// retrieving them from storage with Get before downloading them from the
+// registry, or serve them from storage directly with FS.
+package storage
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrNotExist is returned for packages and files that aren't stored
+var ErrNotExist = os.ErrNotExist
+
+// ErrCorrupt is returned by Get when a stored file doesn't match the
+// integrity recorded when it was stored
+var ErrCorrupt = errors.New("storage: file doesn't match its integrity")
+
+// tempPrefix prefixes temporary directories created by Get and Local
+const tempPrefix = ".storage-"
+
+// FileInfo describes a stored file
+type FileInfo struct {
+	// Path is the slash separated path of the file within its package,
+	// without a leading slash
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// File is a stored file opened for reading
+type File interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// Storage stores the files of packages. Packages are identified by a name
+// unique to the package version and paths within them are slash separated.
+//
+// Directories are implicit, only files are stored.
+type Storage interface {
+	// Stat returns information about the file p in pkg
+	Stat(pkg, p string) (FileInfo, error)
+	// Open opens the file p in pkg
+	Open(pkg, p string) (File, error)
+	// List returns all files in pkg, or ErrNotExist if it hasn't been
+	// completely stored
+	List(pkg string) ([]FileInfo, error)
+	// Integrity returns the Subresource Integrity hash of each file in pkg,
+	// keyed by path, or ErrNotExist if it hasn't been completely stored
+	Integrity(pkg string) (map[string]string, error)
+	// Put stores the files in dir as pkg, replacing any already stored, then
+	// records their integrity, completing pkg. dir is left unmodified.
+	Put(pkg, dir string) error
+	// Delete removes pkg
+	Delete(pkg string) error
+}
+
+// Parse returns the storage described by s, or nil if s is empty.
+//
+// "s3://bucket/prefix" stores packages in an S3 compatible bucket, with the
+// endpoint and region set by the query parameters of the same names and
+// credentials from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+// environment variables. Anything else is a local directory.
+func Parse(s string) (Storage, error) {
+	switch {
+	case s == "":
+		return nil, nil
+	case strings.HasPrefix(s, "s3://"):
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		if u.Host == "" {
+			return nil, errors.New("storage: bucket missing from " + s)
+		}
+		region := u.Query().Get("region")
+		if region == "" {
+			region = "us-east-1"
+		}
+		endpoint := u.Query().Get("endpoint")
+		if endpoint == "" {
+			endpoint = "https://s3." + region + ".amazonaws.com"
+		}
+		return &S3{
+			Endpoint:  strings.TrimSuffix(endpoint, "/"),
+			Bucket:    u.Host,
+			Prefix:    strings.TrimPrefix(u.Path, "/"),
+			Region:    region,
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		}, nil
+	default:
+		return &Local{Dir: strings.TrimPrefix(s, "file://")}, nil
+	}
+}
+
+// cleanPath returns p relative to the package root, or an error if it
+// doesn't refer to a file
+func cleanPath(p string) (string, error) {
+	p = path.Clean("/" + p)[1:]
+	if p == "" {
+		return "", ErrNotExist
+	}
+	return p, nil
+}
+
+// checkPackage returns an error if pkg can't be used as a package name
+func checkPackage(pkg string) error {
+	if pkg == "" || strings.HasPrefix(pkg, ".") || strings.ContainsAny(pkg, `/\`) {
+		return errors.New("storage: invalid package name " + pkg)
+	}
+	return nil
+}
+
+// localFile is a file in a directory passed to Put
+type localFile struct {
+	path     string // slash separated, relative to the directory
+	fullpath string
+}
+
+// walkFiles returns the regular files in dir, following symlinks
+func walkFiles(dir string) ([]localFile, error) {
+	var files []localFile
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if fi, err = os.Stat(p); err != nil || fi.IsDir() {
+				return nil // Broken link, or directory which Walk doesn't follow
+			}
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, localFile{path: filepath.ToSlash(rel), fullpath: p})
+		return nil
+	})
+	return files, err
+}
+
+// manifest returns the integrity recorded by Put for files
+func manifest(files []localFile) ([]byte, error) {
+	hashes := make(map[string]string, len(files))
+	for _, f := range files {
+		in, err := os.Open(f.fullpath)
+		if err != nil {
+			return nil, err
+		}
+		sri, err := hashReader(in)
+		in.Close()
+		if err != nil {
+			return nil, err
+		}
+		hashes[f.path] = sri
+	}
+	return json.Marshal(hashes)
+}
+
+// parseManifest parses the integrity recorded by Put. Markers written
+// before integrity was recorded are empty, those packages are treated as
+// incomplete so that they're stored again.
+func parseManifest(b []byte) (map[string]string, error) {
+	if len(b) == 0 {
+		return nil, ErrNotExist
+	}
+	var hashes map[string]string
+	if err := json.Unmarshal(b, &hashes); err != nil {
+		return nil, fmt.Errorf("storage: invalid integrity: %v", err)
+	}
+	return hashes, nil
+}
+
+// hashReader returns the sha384 Subresource Integrity hash of r
+func hashReader(r io.Reader) (string, error) {
+	h := sha512.New384()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return "sha384-" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// Get copies the files of pkg from s into dest, returning ErrNotExist if
+// pkg isn't completely stored in s, or ErrCorrupt if a file doesn't match
+// the integrity recorded by Put.
+//
+// The files are copied to a temporary directory alongside dest and only
+// moved to dest once all are copied and verified, so dest is either
+// complete or doesn't exist.
+func Get(s Storage, pkg, dest string) error {
+	hashes, err := s.Integrity(pkg)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(dest), tempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	for p, sri := range hashes {
+		p, err := cleanPath(p)
+		if err != nil {
+			continue
+		}
+		got, err := getFile(s, pkg, p, filepath.Join(tmp, filepath.FromSlash(p)))
+		if err != nil {
+			return err
+		}
+		if got != sri {
+			return ErrCorrupt
+		}
+	}
+
+	// TempDir creates directories only accessible by the owner
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		if _, statErr := os.Stat(dest); statErr == nil {
+			return nil // Retrieved concurrently by another process
+		}
+		return err
+	}
+	return nil
+}
+
+// getFile copies the file p in pkg from s to dest, returning its integrity
+func getFile(s Storage, pkg, p, dest string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+
+	in, err := s.Open(pkg, p)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+	sri, err := hashReader(io.TeeReader(in, out))
+	if err != nil {
+		out.Close()
+		return "", err
+	}
+	return sri, out.Close()
+}
+
+// RemoveTemp removes temporary directories left in dir by interrupted
+// calls to Get. It should only be called when none are in progress.
+func RemoveTemp(dir string) error {
+	matches, err := filepath.Glob(filepath.Join(dir, tempPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, m := range matches {
+		if err := os.RemoveAll(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}